@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/whispem/mini-kvstore-go/pkg/store"
+)
+
+// opNames are the names dump prints and filters opcodes by
+var opNames = map[byte]string{
+	store.OpSet:         "set",
+	store.OpDelete:      "delete",
+	store.OpBatchBegin:  "batch-begin",
+	store.OpBatchCommit: "batch-commit",
+	store.OpChunk:       "chunk",
+}
+
+// dumpRecord is one line of a segment dump
+type dumpRecord struct {
+	Offset    uint64 `json:"offset"`
+	Size      uint64 `json:"size"`
+	Op        string `json:"op,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Key       string `json:"key,omitempty"`
+	ValueLen  int    `json:"value_len"`
+	Value     string `json:"value,omitempty"`     // Preview of a UTF-8 value
+	ValueHex  string `json:"value_hex,omitempty"` // Preview of any other value
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Large     bool   `json:"large,omitempty"` // The value describes a large object file
+	Codec     string `json:"codec,omitempty"`
+	KeyID     uint32 `json:"key_id,omitempty"` // Set while the record is still encrypted
+	Checksum  string `json:"checksum,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// dumpEntry is one line of an index snapshot dump
+type dumpEntry struct {
+	Key       string `json:"key"`
+	Segment   uint64 `json:"segment"`
+	Offset    uint64 `json:"offset"`
+	Size      uint32 `json:"size"`
+	Version   uint64 `json:"version"`
+	ValueLen  uint32 `json:"value_len"`
+	StoredLen uint32 `json:"stored_len"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// dumpFilter picks the lines to print
+type dumpFilter struct {
+	prefix string
+	ops    map[string]bool // nil for every opcode
+}
+
+// match reports whether a record with the given opcode and key is printed.
+// Damage with no record to go by is only printed without filters.
+func (f dumpFilter) match(op, key string, hasRecord bool) bool {
+	if !hasRecord {
+		return f.prefix == "" && f.ops == nil
+	}
+	return strings.HasPrefix(key, f.prefix) && (f.ops == nil || f.ops[op])
+}
+
+// runDump prints the records of the segment or index snapshot named in
+// args as JSON lines and returns the exit code
+func runDump(args []string) int {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "only records whose key starts with `prefix`")
+	ops := flags.String("op", "", "only records with these comma-separated opcodes (set, delete, batch-begin, batch-commit, chunk)")
+	preview := flags.Int("preview", 64, "bytes of each value to print")
+	keyFile := flags.String("key-file", "", "keyring file of an encrypted store")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kvstore dump [flags] <segment-N.dat | large-N.dat | index.snapshot>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+
+	filter := dumpFilter{prefix: *prefix}
+	if *ops != "" {
+		filter.ops = make(map[string]bool)
+		for _, op := range strings.Split(*ops, ",") {
+			filter.ops[strings.TrimSpace(op)] = true
+		}
+	}
+
+	var opts []store.Option
+	if *keyFile != "" {
+		keyring, err := store.LoadKeyring(*keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load keyring: %v\n", err)
+			return 2
+		}
+		opts = append(opts, store.WithKeyring(keyring))
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var err error
+	if strings.HasSuffix(path, ".snapshot") {
+		err = dumpSnapshot(enc, path, filter, opts)
+	} else {
+		err = dumpSegment(enc, path, filter, *preview, opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dump %s: %v\n", path, err)
+		return 1
+	}
+	return 0
+}
+
+func dumpSegment(enc *json.Encoder, path string, filter dumpFilter, preview int, opts []store.Option) error {
+	return store.InspectSegment(path, func(e store.SegmentEntry) error {
+		line := dumpRecord{Offset: e.Offset, Size: e.Size}
+		if e.Err != nil {
+			line.Error = e.Err.Error()
+		}
+
+		rec := e.Record
+		if rec == nil {
+			if !filter.match("", "", false) {
+				return nil
+			}
+			return enc.Encode(line)
+		}
+
+		line.Op = opName(rec.Op)
+		if !filter.match(line.Op, rec.Key, true) {
+			return nil
+		}
+		line.Seq = rec.Seq
+		line.Large = rec.Large
+		line.KeyID = rec.KeyID
+		if rec.KeyID == 0 {
+			line.Key = rec.Key
+			line.Value, line.ValueHex = previewValue(rec.Value, preview)
+		}
+		line.ValueLen = len(rec.Value)
+		if rec.Codec != store.CompressionNone {
+			line.ValueLen = int(rec.RawSize)
+		}
+		if e.Codec != store.CompressionNone {
+			line.Codec = e.Codec.String()
+		}
+		if rec.ExpiresAt != 0 {
+			line.ExpiresAt = time.Unix(0, rec.ExpiresAt).UTC().Format(time.RFC3339Nano)
+		}
+		line.Checksum = "ok"
+		if errors.Is(e.Err, store.ErrChecksumMismatch) {
+			line.Checksum = "mismatch"
+		}
+		return enc.Encode(line)
+	}, opts...)
+}
+
+func dumpSnapshot(enc *json.Encoder, path string, filter dumpFilter, opts []store.Option) error {
+	info, err := store.InspectSnapshot(path, opts...)
+	if err != nil {
+		return err
+	}
+
+	// Every key in the index was last written by a set
+	if !filter.match(opName(store.OpSet), "", true) {
+		return nil
+	}
+	info.Index.Ascend(filter.prefix, func(key string, entry *store.IndexEntry) bool {
+		if !strings.HasPrefix(key, filter.prefix) {
+			return false
+		}
+		line := dumpEntry{
+			Key:       key,
+			Segment:   entry.SegmentID,
+			Offset:    entry.Offset,
+			Size:      entry.Size,
+			Version:   entry.Version,
+			ValueLen:  entry.ValueSize,
+			StoredLen: entry.StoredSize,
+		}
+		if entry.ExpiresAt != 0 {
+			line.ExpiresAt = time.Unix(0, entry.ExpiresAt).UTC().Format(time.RFC3339Nano)
+		}
+		err = enc.Encode(line)
+		return err == nil
+	})
+	return err
+}
+
+// opName returns the name of an opcode, or its number if it has none
+func opName(op byte) string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return strconv.Itoa(int(op))
+}
+
+// previewValue returns up to n bytes of value as text if they are valid
+// UTF-8, or else as hex
+func previewValue(value []byte, n int) (string, string) {
+	if len(value) > n {
+		value = value[:n]
+	}
+	if utf8.Valid(value) {
+		return string(value), ""
+	}
+	return "", hex.EncodeToString(value)
+}
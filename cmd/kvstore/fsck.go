@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/whispem/mini-kvstore-go/pkg/store"
+)
+
+// runFsck checks the store directory named in args and, with --repair,
+// rewrites it without the damaged records. It returns the exit code: 0 if
+// the store is intact or was repaired, 1 if it is damaged, 2 on bad usage
+// or failure.
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "rewrite the store without damaged records, keeping the original as <dir>.damaged")
+	keyFile := flags.String("key-file", "", "keyring file of an encrypted store")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kvstore fsck [--repair] [--key-file <file>] <dir>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	dir := filepath.Clean(flags.Arg(0))
+
+	var opts []store.Option
+	if *keyFile != "" {
+		keyring, err := store.LoadKeyring(*keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load keyring: %v\n", err)
+			return 2
+		}
+		opts = append(opts, store.WithKeyring(keyring))
+	}
+
+	check := store.Check
+	if *repair {
+		check = store.Repair
+	}
+	report, err := check(dir, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck %s: %v\n", dir, err)
+		return 2
+	}
+
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	for _, note := range report.Notes {
+		fmt.Printf("note: %s\n", note)
+	}
+	fmt.Printf("%d segments, %d large objects, %d intact records, %d problems\n",
+		report.Segments, report.Large, report.Records, len(report.Problems))
+
+	switch {
+	case report.OK():
+		return 0
+	case *repair:
+		fmt.Printf("Repaired %s; the damaged store was moved to %s.damaged\n", dir, dir)
+		return 0
+	default:
+		fmt.Println("Run with --repair to rewrite the store without the damaged records")
+		return 1
+	}
+}
@@ -3,14 +3,33 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/whispem/mini-kvstore-go/pkg/store"
 )
 
 func main() {
-	kvstore, err := store.Open("db")
+	// Subcommands work on a store directory instead of starting the shell
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(runFsck(os.Args[2:]))
+		case "dump":
+			os.Exit(runDump(os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n", os.Args[1])
+			fmt.Fprintln(os.Stderr, "Usage: kvstore [fsck [--repair] <dir> | dump [flags] <file>]")
+			os.Exit(2)
+		}
+	}
+
+	// Keep the prompt clean: only problems are logged, and to stderr
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	kvstore, err := store.OpenWithOptions("db", store.WithLogger(logger))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to open store: %v\n", err)
 		os.Exit(1)
@@ -49,6 +68,45 @@ func main() {
 				fmt.Println("OK")
 			}
 
+		case "setex":
+			parts = strings.SplitN(line, " ", 4)
+			if len(parts) < 4 {
+				fmt.Println("Usage: setex <key> <ttl> <value>")
+				continue
+			}
+			key := parts[1]
+			value := parts[3]
+
+			ttl, err := time.ParseDuration(parts[2])
+			if err != nil {
+				fmt.Printf("Invalid ttl %q (use e.g. 30s, 5m, 1h)\n", parts[2])
+				continue
+			}
+
+			if err := kvstore.SetWithTTL(key, []byte(value), ttl); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			} else {
+				fmt.Println("OK")
+			}
+
+		case "ttl":
+			if len(parts) < 2 {
+				fmt.Println("Usage: ttl <key>")
+				continue
+			}
+			key := parts[1]
+
+			ttl, err := kvstore.TTL(key)
+			if err == store.ErrNotFound {
+				fmt.Println("Key not found")
+			} else if err != nil {
+				fmt.Printf("Error: %v\n", err)
+			} else if ttl == 0 {
+				fmt.Println("No expiry")
+			} else {
+				fmt.Println(ttl.Round(time.Millisecond))
+			}
+
 		case "get":
 			if len(parts) < 2 {
 				fmt.Println("Usage: get <key>")
@@ -118,7 +176,9 @@ func main() {
 func printHelp() {
 	fmt.Println("Available commands:")
 	fmt.Println("  set <key> <value>  - Store a key-value pair")
+	fmt.Println("  setex <key> <ttl> <value> - Store a pair that expires after ttl (e.g. 30s)")
 	fmt.Println("  get <key>          - Retrieve a value")
+	fmt.Println("  ttl <key>          - Show the remaining lifetime of a key")
 	fmt.Println("  delete <key>       - Remove a key")
 	fmt.Println("  list               - List all keys")
 	fmt.Println("  compact            - Compact storage")
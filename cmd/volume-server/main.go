@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"os"
 
@@ -12,24 +11,35 @@ import (
 func main() {
 	cfg := config.FromEnv()
 
-	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
+	logger, err := cfg.Logger(os.Stderr)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v\n", err)
+	}
+
+	opts, err := cfg.StoreOptions()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v\n", err)
+	}
 
-	fmt.Println("Starting volume server:")
-	fmt.Printf("  volume_id = %s\n", cfg.VolumeID)
-	fmt.Printf("  data_dir  = %s\n", cfg.DataDir)
-	fmt.Printf("  bind_addr = %s\n", addr)
-	fmt.Printf("  compaction_threshold = %d\n", cfg.CompactionThreshold)
-	fmt.Printf("  compaction_interval = %ds\n", cfg.CompactionIntervalSecs)
-	fmt.Println()
+	logger.Info("starting volume server",
+		"volume", cfg.VolumeID,
+		"data_dir", cfg.DataDir,
+		"port", cfg.Port,
+		"compaction_garbage_ratio", cfg.CompactionGarbageRatio,
+		"compaction_interval_secs", cfg.CompactionIntervalSecs,
+		"sync_mode", cfg.SyncMode,
+		"sync_interval_ms", cfg.SyncIntervalMs,
+		"compression", cfg.Compression,
+		"encryption", cfg.EncryptionKeyFile != "" || cfg.EncryptionKey != "",
+		"segment_size_mb", cfg.SegmentSizeMB,
+		"bloom_expected_keys", cfg.BloomExpectedKeys,
+		"bloom_fp_rate", cfg.BloomFPRate,
+		"read_only", cfg.ReadOnly,
+		"admin_backup", cfg.AdminBackup,
+	)
 
-	if err := volume.StartVolumeServer(
-		addr,
-		cfg.VolumeID,
-		cfg.DataDir,
-		cfg.CompactionThreshold,
-		cfg.CompactionIntervalSecs,
-	); err != nil {
-		log.Fatalf("Server failed: %v\n", err)
+	if err := volume.StartVolumeServer(cfg, logger, opts...); err != nil {
+		logger.Error("server failed", "err", err)
 		os.Exit(1)
 	}
 }
@@ -3,13 +3,11 @@ module github.com/whispem/mini-kvstore-go
 go 1.21
 
 require (
-	github.com/bits-and-blooms/bloom/v3 v3.7.0
 	github.com/gorilla/mux v1.8.1
 	github.com/stretchr/testify v1.8.4
 )
 
 require (
-	github.com/bits-and-blooms/bitset v1.13.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -1,44 +1,152 @@
 package config
 
 import (
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"strconv"
+	"time"
+
+	"github.com/whispem/mini-kvstore-go/pkg/store"
 )
 
 // Config holds all application configuration
 type Config struct {
-	Port                    int
-	VolumeID                string
-	DataDir                 string
-	CompactionThreshold     int
-	CompactionIntervalSecs  int
-	MaxRequestSizeMB        int
+	Port                   int
+	VolumeID               string
+	DataDir                string
+	CompactionGarbageRatio float64
+	CompactionIntervalSecs int
+	MaxRequestSizeMB       int
+	SyncMode               string
+	SyncIntervalMs         int
+	Compression            string
+	EncryptionKey          string
+	EncryptionKeyFile      string
+	SegmentSizeMB          int
+	BloomExpectedKeys      int
+	BloomFPRate            float64
+	ReadOnly               bool
+	// AdminBackup serves GET /admin/backup, which exports every blob to
+	// anyone who can reach the port, so it is off unless asked for
+	AdminBackup bool
+	LogFormat   string
+	LogLevel    string
 }
 
 // FromEnv creates config from environment variables
 func FromEnv() *Config {
 	return &Config{
-		Port:                    getEnvInt("PORT", 9002),
-		VolumeID:                getEnvString("VOLUME_ID", "vol-1"),
-		DataDir:                 getEnvString("DATA_DIR", "data"),
-		CompactionThreshold:     getEnvInt("COMPACTION_THRESHOLD", 5),
-		CompactionIntervalSecs:  getEnvInt("COMPACTION_INTERVAL_SECS", 60),
-		MaxRequestSizeMB:        getEnvInt("MAX_REQUEST_SIZE_MB", 100),
+		Port:                   getEnvInt("PORT", 9002),
+		VolumeID:               getEnvString("VOLUME_ID", "vol-1"),
+		DataDir:                getEnvString("DATA_DIR", "data"),
+		CompactionGarbageRatio: getEnvFloat("COMPACTION_GARBAGE_RATIO", 0.5),
+		CompactionIntervalSecs: getEnvInt("COMPACTION_INTERVAL_SECS", 60),
+		MaxRequestSizeMB:       getEnvInt("MAX_REQUEST_SIZE_MB", 100),
+		SyncMode:               getEnvString("SYNC_MODE", "always"),
+		SyncIntervalMs:         getEnvInt("SYNC_INTERVAL_MS", 100),
+		Compression:            getEnvString("COMPRESSION", "none"),
+		EncryptionKey:          getEnvString("ENCRYPTION_KEY", ""),
+		EncryptionKeyFile:      getEnvString("ENCRYPTION_KEY_FILE", ""),
+		SegmentSizeMB:          getEnvInt("SEGMENT_SIZE_MB", 16),
+		BloomExpectedKeys:      getEnvInt("BLOOM_EXPECTED_KEYS", 50000),
+		BloomFPRate:            getEnvFloat("BLOOM_FP_RATE", 0.01),
+		ReadOnly:               getEnvBool("READ_ONLY", false),
+		AdminBackup:            getEnvBool("ADMIN_BACKUP", false),
+		LogFormat:              getEnvString("LOG_FORMAT", "text"),
+		LogLevel:               getEnvString("LOG_LEVEL", "info"),
 	}
 }
 
 // Default returns default configuration
 func Default() *Config {
 	return &Config{
-		Port:                    9002,
-		VolumeID:                "vol-1",
-		DataDir:                 "data",
-		CompactionThreshold:     5,
-		CompactionIntervalSecs:  60,
-		MaxRequestSizeMB:        100,
+		Port:                   9002,
+		VolumeID:               "vol-1",
+		DataDir:                "data",
+		CompactionGarbageRatio: 0.5,
+		CompactionIntervalSecs: 60,
+		MaxRequestSizeMB:       100,
+		SyncMode:               "always",
+		SyncIntervalMs:         100,
+		Compression:            "none",
+		SegmentSizeMB:          16,
+		BloomExpectedKeys:      50000,
+		BloomFPRate:            0.01,
+		LogFormat:              "text",
+		LogLevel:               "info",
 	}
 }
 
+// Logger builds a logger writing to w in the configured format ("text" or
+// "json") at the configured level ("debug", "info", "warn" or "error")
+func (c *Config) Logger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return nil, fmt.Errorf("log level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch c.LogFormat {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("log format: unknown format %q (want text or json)", c.LogFormat)
+	}
+}
+
+// StoreOptions translates the storage settings into options for
+// store.OpenWithOptions
+func (c *Config) StoreOptions() ([]store.Option, error) {
+	syncPolicy, err := store.ParseSyncPolicy(c.SyncMode, time.Duration(c.SyncIntervalMs)*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("sync: %w", err)
+	}
+
+	compression, err := store.ParseCompression(c.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("compression: %w", err)
+	}
+
+	if c.SegmentSizeMB <= 0 {
+		return nil, fmt.Errorf("segment size: %d MB is not positive", c.SegmentSizeMB)
+	}
+	if c.BloomExpectedKeys <= 0 {
+		return nil, fmt.Errorf("bloom filter: %d expected keys is not positive", c.BloomExpectedKeys)
+	}
+
+	opts := []store.Option{
+		store.WithSyncPolicy(syncPolicy),
+		store.WithCompression(compression),
+		store.WithSegmentSize(uint64(c.SegmentSizeMB) * 1024 * 1024),
+		store.WithBloomFilter(uint(c.BloomExpectedKeys), c.BloomFPRate),
+	}
+
+	// Encryption is off unless a key is configured; a key file wins over
+	// an inline key
+	var keyring *store.Keyring
+	if c.EncryptionKeyFile != "" {
+		keyring, err = store.LoadKeyring(c.EncryptionKeyFile)
+	} else if c.EncryptionKey != "" {
+		keyring, err = store.ParseKeyring(c.EncryptionKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	if keyring != nil {
+		opts = append(opts, store.WithKeyring(keyring))
+	}
+
+	if c.ReadOnly {
+		opts = append(opts, store.WithReadOnly())
+	}
+
+	return opts, nil
+}
+
 func getEnvString(key, defaultValue string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
@@ -54,3 +162,21 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if val := os.Getenv(key); val != "" {
+		if floatVal, err := strconv.ParseFloat(val, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if val := os.Getenv(key); val != "" {
+		if boolVal, err := strconv.ParseBool(val); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,292 @@
+package store
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupFile is one file of a backup, either read from disk or held in
+// memory
+type backupFile struct {
+	name string
+	path string // Segment to copy the first size bytes of
+	size int64
+	data []byte
+}
+
+// Backup writes a consistent point-in-time copy of the store to w as a tar
+// archive of its segments, large objects, index snapshot and bloom filter.
+// The store keeps serving reads and writes meanwhile: writes made after
+// Backup starts are not in the archive, and compaction leaves the segments
+// it copies in place until it is done. Restore unpacks the archive into a
+// directory that Open takes as is.
+func (s *KVStore) Backup(w io.Writer) error {
+	files, view, err := s.backupFiles()
+	if err != nil {
+		return err
+	}
+	defer view.Release()
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, f := range files {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.name,
+			Size:     f.size,
+			Mode:     0644,
+			ModTime:  now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if f.data != nil {
+			if _, err := tw.Write(f.data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copySegment(tw, f.path, f.size); err != nil {
+			return fmt.Errorf("back up %s: %w", f.name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// backupFiles lists what goes into a backup as of now and returns a
+// snapshot that keeps the files involved on disk until it is released
+func (s *KVStore) backupFiles() ([]backupFile, *Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.snapshot()
+	snapData, err := s.keys.sealFile(encodeSnapshot(state))
+	if err != nil {
+		return nil, nil, err
+	}
+	bloomData, err := s.keys.sealFile(encodeBloom(s.bloom))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []backupFile
+	for _, st := range state.segments {
+		path := segmentPath(s.baseDir, st.ID)
+		size := int64(s.activeOffset)
+		if st.ID != s.activeSegmentID {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			size = info.Size()
+		}
+		// Nothing has been written to an empty active segment, and
+		// compaction may remove it
+		if size == 0 {
+			continue
+		}
+		files = append(files, backupFile{name: filepath.Base(path), path: path, size: size})
+	}
+	// Large objects are never modified, and the snapshot keeps them in place
+	for _, f := range s.liveLarge() {
+		path := largePath(s.baseDir, f.version, f.gen)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, backupFile{name: filepath.Base(path), path: path, size: info.Size()})
+	}
+	files = append(files,
+		backupFile{name: snapshotFile, size: int64(len(snapData)), data: snapData},
+		backupFile{name: bloomFile, size: int64(len(bloomData)), data: bloomData},
+	)
+
+	return files, s.newSnapshot(), nil
+}
+
+// copySegment copies the first size bytes of a segment or large object to w
+func copySegment(w io.Writer, path string, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyN(w, file, size)
+	return err
+}
+
+// Restore unpacks a backup written by Backup into dir, which must not
+// exist or be empty. Every record and index file is checked before
+// anything is installed; a damaged archive leaves dir untouched. opts
+// supply the keyring of an encrypted store, without which its index files
+// cannot be checked.
+func Restore(r io.Reader, dir string, opts ...Option) error {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := ensureEmptyDir(dir); err != nil {
+		return err
+	}
+
+	// Unpack next to dir so the final rename cannot cross file systems
+	tmpDir := filepath.Clean(dir) + ".restore"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := unpackBackup(r, tmpDir); err != nil {
+		return err
+	}
+	if err := verifyBackup(tmpDir, o.keyring); err != nil {
+		return err
+	}
+
+	if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filepath.Clean(dir)))
+}
+
+// unpackBackup writes the files of a backup archive to dir, refusing any
+// that a backup would not contain
+func unpackBackup(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read backup: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !isBackupFile(hdr.Name) {
+			return fmt.Errorf("read backup: %w: unexpected entry %q", ErrCorrupted, hdr.Name)
+		}
+
+		if err := writeSyncedFile(filepath.Join(dir, hdr.Name), tr); err != nil {
+			return fmt.Errorf("restore %s: %w", hdr.Name, err)
+		}
+	}
+
+	return syncDir(dir)
+}
+
+// isBackupFile reports whether name is a file Backup writes
+func isBackupFile(name string) bool {
+	if name == snapshotFile || name == bloomFile {
+		return true
+	}
+	if _, ok := parseLargeName(name); ok {
+		return true
+	}
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+		return false
+	}
+	_, err := strconv.ParseUint(name[len(segmentPrefix):len(name)-len(segmentSuffix)], 10, 64)
+	return err == nil
+}
+
+// writeSyncedFile creates path with the contents of r and fsyncs it
+func writeSyncedFile(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// verifyBackup checks every segment and large object of an unpacked backup
+// record by record, along with its index snapshot and bloom filter
+func verifyBackup(dir string, keys *Keyring) error {
+	segments, err := findSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, segID := range segments {
+		if err := verifySegment(segmentPath(dir, segID)); err != nil {
+			return fmt.Errorf("verify segment %d: %w", segID, err)
+		}
+	}
+
+	files, err := findLarge(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		path := largePath(dir, f.version, f.gen)
+		if err := verifyLarge(path); err != nil {
+			return fmt.Errorf("verify large object %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	// The snapshot comes last and lists every segment, so an archive cut
+	// short between files is caught here
+	snap, err := readSnapshotFile(filepath.Join(dir, snapshotFile), keys)
+	if err != nil {
+		return fmt.Errorf("verify index snapshot: %w", err)
+	}
+	if !snap.covers(dir, segments) {
+		return fmt.Errorf("verify index snapshot: %w: backup is missing segments", ErrCorrupted)
+	}
+	if _, err := loadBloom(filepath.Join(dir, bloomFile), keys); err != nil {
+		return fmt.Errorf("verify bloom filter: %w", err)
+	}
+
+	return nil
+}
+
+// verifySegment reads every record of a segment, which checks its CRC, and
+// fails on anything left over: a backup never ends in a torn write
+func verifySegment(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := newSizedReader(file, -1)
+	if err != nil {
+		return err
+	}
+	_, _, err = scanCommitted(r, func(*Record, uint64) error { return nil })
+	return err
+}
+
+// verifyLarge reads every chunk of a large object file, which checks its
+// CRC
+func verifyLarge(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return scanLarge(file, nil)
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// contents returns every key of a store with its value and version
+func contents(t *testing.T, store *KVStore) map[string]string {
+	t.Helper()
+
+	m := make(map[string]string)
+	for _, key := range store.ListKeys() {
+		value, version, err := store.GetWithVersion(key)
+		require.NoError(t, err, key)
+		m[key] = fmt.Sprintf("%s@%d", value, version)
+	}
+	return m
+}
+
+// compactingWriter compacts its store on the first write, while the backup
+// writing to it is under way
+type compactingWriter struct {
+	bytes.Buffer
+	store     *KVStore
+	compacted bool
+}
+
+func (w *compactingWriter) Write(p []byte) (int, error) {
+	if !w.compacted {
+		w.compacted = true
+		if err := w.store.Compact(); err != nil {
+			return 0, err
+		}
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	restored := dir + "-restored"
+	require.NoError(t, os.RemoveAll(restored))
+	defer os.RemoveAll(restored)
+
+	store, err := OpenWithOptions(dir, WithSegmentSize(256))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+	for i := 0; i < 30; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%02d", i), bytes.Repeat([]byte{'a' + byte(i%26)}, 40)))
+	}
+	require.NoError(t, store.Delete("key07"))
+	want := contents(t, store)
+
+	// Compaction and writes during the backup do not show up in it
+	w := &compactingWriter{store: store}
+	require.NoError(t, store.Backup(w))
+	require.True(t, w.compacted)
+	require.NoError(t, store.Set("key00", []byte("after backup")))
+	require.NoError(t, store.Delete("key01"))
+
+	require.NoError(t, Restore(bytes.NewReader(w.Bytes()), restored))
+	copyStore, err := Open(restored)
+	require.NoError(t, err)
+	defer copyStore.Close()
+	assert.Equal(t, want, contents(t, copyStore))
+
+	// The restored store carries on where the backup left off
+	require.NoError(t, copyStore.Set("new", []byte("v")))
+	_, version, err := copyStore.GetWithVersion("new")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(32), version)
+}
+
+// rewriteBackup copies a backup archive, passing each file through fn
+func rewriteBackup(t *testing.T, archive []byte, fn func(hdr *tar.Header, data []byte) []byte) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(archive))
+	tw := tar.NewWriter(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		data = fn(hdr, data)
+		hdr.Size = int64(len(data))
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return out.Bytes()
+}
+
+func TestRestoreRejectsDamagedBackup(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer cleanupTestStore(t, store, dir)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+	var buf bytes.Buffer
+	require.NoError(t, store.Backup(&buf))
+
+	restored := dir + "-restored"
+	require.NoError(t, os.RemoveAll(restored))
+	defer os.RemoveAll(restored)
+
+	for name, archive := range map[string][]byte{
+		"flipped byte": rewriteBackup(t, buf.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == filepath.Base(segmentPath(dir, 1)) {
+				data[len(data)/2] ^= 0xff
+			}
+			return data
+		}),
+		"torn segment": rewriteBackup(t, buf.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == filepath.Base(segmentPath(dir, 1)) {
+				return data[:len(data)-3]
+			}
+			return data
+		}),
+		"damaged snapshot": rewriteBackup(t, buf.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == snapshotFile {
+				data[10] ^= 0xff
+			}
+			return data
+		}),
+		"missing segment": rewriteBackup(t, buf.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == filepath.Base(segmentPath(dir, 1)) {
+				hdr.Name = filepath.Base(segmentPath(dir, 99))
+			}
+			return data
+		}),
+		"cut short": buf.Bytes()[:1024],
+		"foreign file": rewriteBackup(t, buf.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == bloomFile {
+				hdr.Name = "../escape"
+			}
+			return data
+		}),
+	} {
+		err := Restore(bytes.NewReader(archive), restored)
+		assert.Error(t, err, name)
+		_, err = os.Stat(restored)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	// Nor does it overwrite an existing store
+	assert.Error(t, Restore(bytes.NewReader(buf.Bytes()), dir))
+}
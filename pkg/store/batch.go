@@ -0,0 +1,233 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errIncompleteBatch reports a batch whose commit marker never made it to
+// disk
+var errIncompleteBatch = errors.New("batch without commit marker")
+
+// Batch collects sets and deletes that KVStore.Write applies atomically
+type Batch struct {
+	records []*Record
+}
+
+// NewBatch creates an empty batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Set queues a key-value pair to be stored
+func (b *Batch) Set(key string, value []byte) {
+	valueCopy := make([]byte, len(value))
+	copy(valueCopy, value)
+	b.records = append(b.records, &Record{Op: OpSet, Key: key, Value: valueCopy})
+}
+
+// Delete queues a key to be removed
+func (b *Batch) Delete(key string) {
+	b.records = append(b.records, &Record{Op: OpDelete, Key: key})
+}
+
+// Len returns the number of queued operations
+func (b *Batch) Len() int {
+	return len(b.records)
+}
+
+// Reset empties the batch so it can be reused
+func (b *Batch) Reset() {
+	b.records = b.records[:0]
+}
+
+// Write applies every operation in the batch, or none of them if the
+// process crashes before the batch is on disk
+func (s *KVStore) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	ticket, err := s.writeBatch(b)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.waitDurable(ticket)
+}
+
+// writeBatch appends a framed batch and applies it; callers hold s.mu
+func (s *KVStore) writeBatch(b *Batch) (uint64, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	records := make([]*Record, len(b.records))
+	sealed := make([]*Record, len(b.records))
+	for i, rec := range b.records {
+		s.seq++
+		rec.Seq = s.seq
+		records[i] = compressRecord(rec, s.compression)
+
+		var err error
+		if sealed[i], err = s.keys.sealRecord(records[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	// Encode the whole frame first so it reaches the segment in one write
+	var buf bytes.Buffer
+	begin := batchMarker(OpBatchBegin, len(records))
+	commit := batchMarker(OpBatchCommit, len(records))
+	for _, rec := range append(append([]*Record{begin}, sealed...), commit) {
+		if err := WriteRecord(&buf, rec); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := s.activeWriter.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := s.activeWriter.Flush(); err != nil {
+		return 0, err
+	}
+	s.written++
+
+	// The markers themselves are garbage as soon as they are written
+	s.applyMarker(begin, s.activeOffset)
+
+	for i, rec := range records {
+		entry := &IndexEntry{
+			SegmentID:  s.activeSegmentID,
+			Offset:     s.activeOffset,
+			Size:       recordSize(sealed[i]),
+			ValueSize:  valueSize(rec),
+			StoredSize: storedValueSize(rec),
+			Version:    rec.Seq,
+			ExpiresAt:  rec.ExpiresAt,
+		}
+		s.activeOffset += uint64(entry.Size)
+		s.activeHints = append(s.activeHints, newHintEntry(rec.Op, rec.Key, entry))
+
+		if rec.Op == OpSet {
+			s.applySet(rec.Key, entry)
+		} else {
+			s.applyDelete(rec.Key, entry)
+		}
+	}
+	s.applyMarker(commit, s.activeOffset)
+
+	if s.activeOffset >= s.maxSegmentSize {
+		if err := s.rotateSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.written, nil
+}
+
+// applyMarker accounts for a batch marker appended to the active segment
+func (s *KVStore) applyMarker(marker *Record, offset uint64) {
+	size := recordSize(marker)
+	s.segStat(s.activeSegmentID).DeadBytes += uint64(size)
+	s.activeOffset += uint64(size)
+	s.activeHints = append(s.activeHints, hintEntry{
+		Op:     marker.Op,
+		Offset: offset,
+		Size:   size,
+	})
+}
+
+// scanCommitted reads records from r and calls fn for each one that is
+// not part of an unfinished batch. A batch is delivered begin marker
+// first, then its operations, then its commit marker, and only once the
+// commit marker has been read. It returns the offset just past the last
+// delivered record and the offset at which reading stopped.
+func scanCommitted(r io.Reader, fn func(rec *Record, offset uint64) error) (uint64, uint64, error) {
+	type pendingRecord struct {
+		rec    *Record
+		offset uint64
+	}
+
+	var offset, valid uint64
+	var pending []pendingRecord
+	inBatch := false
+
+	for {
+		rec, err := ReadRecord(r)
+		if err == io.EOF {
+			if inBatch {
+				return valid, offset, fmt.Errorf("batch at offset %d: %w", valid, errIncompleteBatch)
+			}
+			return valid, offset, nil
+		}
+		if err != nil {
+			return valid, offset, fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+
+		size := uint64(storedSize(rec))
+		switch rec.Op {
+		case OpSet, OpDelete:
+			if inBatch {
+				pending = append(pending, pendingRecord{rec, offset})
+				break
+			}
+			if err := fn(rec, offset); err != nil {
+				return valid, offset, err
+			}
+			valid = offset + size
+		case OpBatchBegin:
+			if inBatch {
+				return valid, offset, fmt.Errorf("record at offset %d: nested batch: %w", offset, ErrCorrupted)
+			}
+			inBatch = true
+			pending = append(pending[:0], pendingRecord{rec, offset})
+		case OpBatchCommit:
+			if !inBatch || !matchesBatch(pending[0].rec, rec, len(pending)-1) {
+				return valid, offset, fmt.Errorf("record at offset %d: unmatched batch commit: %w", offset, ErrCorrupted)
+			}
+			for _, p := range append(pending, pendingRecord{rec, offset}) {
+				if err := fn(p.rec, p.offset); err != nil {
+					return valid, p.offset, err
+				}
+			}
+			inBatch = false
+			pending = pending[:0]
+			valid = offset + size
+		default:
+			return valid, offset, fmt.Errorf("record at offset %d: %w: %d", offset, ErrInvalidOpcode, rec.Op)
+		}
+		offset += size
+	}
+}
+
+// batchMarker builds a begin or commit record for a batch of n operations
+func batchMarker(op byte, n int) *Record {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, uint32(n))
+	return &Record{Op: op, Value: value}
+}
+
+// batchCount returns the operation count stored in a batch marker
+func batchCount(rec *Record) (int, bool) {
+	if len(rec.Value) != 4 {
+		return 0, false
+	}
+	return int(binary.LittleEndian.Uint32(rec.Value)), true
+}
+
+// matchesBatch reports whether a begin and commit marker agree with each
+// other and with the n operations read between them
+func matchesBatch(begin, commit *Record, n int) bool {
+	want, ok := batchCount(begin)
+	if !ok {
+		return false
+	}
+	got, ok := batchCount(commit)
+	return ok && got == want && n == want
+}
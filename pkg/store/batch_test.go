@@ -0,0 +1,90 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.Set("stale", []byte("x")))
+
+	b := NewBatch()
+	b.Set("a", []byte("1"))
+	b.Set("b", []byte("2"))
+	b.Delete("stale")
+	require.Equal(t, 3, b.Len())
+	require.NoError(t, store.Write(b))
+
+	check := func() {
+		val, err := store.Get("a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("1"), val)
+		val, err = store.Get("b")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("2"), val)
+		_, err = store.Get("stale")
+		assert.Equal(t, ErrNotFound, err)
+	}
+	check()
+
+	// Replay from the segment, then from its hint file
+	require.NoError(t, store.Close())
+	store, err := Open(dir)
+	require.NoError(t, err)
+	check()
+	require.NoError(t, store.Close())
+	store, err = Open(dir)
+	require.NoError(t, err)
+	check()
+}
+
+func TestTornBatchIsDiscarded(t *testing.T) {
+	for _, cut := range []string{"mid-record", "before-commit"} {
+		t.Run(cut, func(t *testing.T) {
+			store, dir := setupTestStore(t)
+			defer func() { cleanupTestStore(t, store, dir) }()
+
+			require.NoError(t, store.Set("before", []byte("ok")))
+			sizeBefore := store.activeOffset
+
+			b := NewBatch()
+			b.Set("a", []byte("1"))
+			b.Set("b", []byte("2"))
+			require.NoError(t, store.Write(b))
+			segID := store.activeSegmentID
+			commitSize := uint64(recordSize(batchMarker(OpBatchCommit, 2)))
+			size := store.activeOffset
+			require.NoError(t, store.Close())
+
+			// Simulate a crash that left only part of the batch on disk
+			path := segmentPath(dir, segID)
+			require.NoError(t, os.Remove(hintPath(dir, segID)))
+			newSize := size - commitSize
+			if cut == "mid-record" {
+				newSize -= 5
+			}
+			require.NoError(t, os.Truncate(path, int64(newSize)))
+
+			store, err := Open(dir)
+			require.NoError(t, err)
+
+			val, err := store.Get("before")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("ok"), val)
+			_, err = store.Get("a")
+			assert.Equal(t, ErrNotFound, err)
+			_, err = store.Get("b")
+			assert.Equal(t, ErrNotFound, err)
+
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, int64(sizeBefore), info.Size())
+		})
+	}
+}
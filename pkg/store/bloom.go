@@ -1,41 +1,184 @@
 package store
 
 import (
+	"bytes"
 	"crypto/sha256"
-
-	"github.com/bits-and-blooms/bloom/v3"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
 )
 
-// BloomIndex provides fast negative lookups
+const bloomFile = "index.bloom"
+
+var bloomMagic = [8]byte{'K', 'V', 'B', 'L', 'O', 'O', 'M', '1'}
+
+// BloomIndex provides fast negative lookups. It is a counting filter: each
+// slot holds a counter rather than a bit, so keys can be removed again. A
+// counter that saturates stays put, which can only cost false positives.
 type BloomIndex struct {
-	filter *bloom.BloomFilter
+	counters []uint8
+	hashes   uint32
+
+	capacity uint    // Keys the filter was sized for
+	fpRate   float64 // False-positive rate at capacity
+	count    uint    // Keys currently in the filter
 }
 
 // NewBloomIndex creates a new bloom filter
 func NewBloomIndex(expectedItems uint) *BloomIndex {
 	// False positive rate of 1%
-	filter := bloom.NewWithEstimates(expectedItems, 0.01)
+	return NewBloomIndexWithRate(expectedItems, 0.01)
+}
+
+// NewBloomIndexWithRate creates a bloom filter sized for expectedItems
+// keys at the given false-positive rate
+func NewBloomIndexWithRate(expectedItems uint, falsePositiveRate float64) *BloomIndex {
+	if expectedItems == 0 {
+		expectedItems = 1
+	}
+	n := float64(expectedItems)
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/n*math.Ln2))
 
 	return &BloomIndex{
-		filter: filter,
+		counters: make([]uint8, uint64(m)),
+		hashes:   uint32(k),
+		capacity: expectedItems,
+		fpRate:   falsePositiveRate,
 	}
 }
 
 // Insert adds a key to the bloom filter
 func (b *BloomIndex) Insert(key string) {
-	hash := hashKey(key)
-	b.filter.Add(hash[:])
+	b.each(key, func(i uint64) {
+		if b.counters[i] < math.MaxUint8 {
+			b.counters[i]++
+		}
+	})
+	b.count++
+}
+
+// Remove takes a key out of the filter. Only remove keys that were
+// inserted; anything else corrupts the counts of other keys.
+func (b *BloomIndex) Remove(key string) {
+	b.each(key, func(i uint64) {
+		if c := b.counters[i]; c > 0 && c < math.MaxUint8 {
+			b.counters[i]--
+		}
+	})
+	if b.count > 0 {
+		b.count--
+	}
 }
 
 // MightContain checks if a key might exist
 // Returns false if definitely doesn't exist
 // Returns true if might exist (could be false positive)
 func (b *BloomIndex) MightContain(key string) bool {
+	found := true
+	b.each(key, func(i uint64) {
+		if b.counters[i] == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// Len returns the number of keys in the filter
+func (b *BloomIndex) Len() uint {
+	return b.count
+}
+
+// Capacity returns the number of keys the filter was sized for
+func (b *BloomIndex) Capacity() uint {
+	return b.capacity
+}
+
+// each calls fn with the counter index of every hash of key, derived from
+// two halves of its SHA-256 by double hashing
+func (b *BloomIndex) each(key string, fn func(i uint64)) {
 	hash := hashKey(key)
-	return b.filter.Test(hash[:])
+	h1 := binary.LittleEndian.Uint64(hash[0:8])
+	h2 := binary.LittleEndian.Uint64(hash[8:16]) | 1
+	m := uint64(len(b.counters))
+	for i := uint64(0); i < uint64(b.hashes); i++ {
+		fn((h1 + i*h2) % m)
+	}
 }
 
 // hashKey computes SHA256 hash of a key
 func hashKey(key string) [32]byte {
 	return sha256.Sum256([]byte(key))
 }
+
+// saveBloom writes the filter to path via a temporary file, sealing it with
+// keys when the store is encrypted
+func saveBloom(b *BloomIndex, path string, keys *Keyring) error {
+	data, err := keys.sealFile(encodeBloom(b))
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// encodeBloom lays the filter out as magic, sizing, counters and a CRC32
+// of everything before it
+func encodeBloom(b *BloomIndex) []byte {
+	le := binary.LittleEndian
+
+	buf := append([]byte(nil), bloomMagic[:]...)
+	buf = le.AppendUint64(buf, uint64(b.capacity))
+	buf = le.AppendUint64(buf, math.Float64bits(b.fpRate))
+	buf = le.AppendUint32(buf, b.hashes)
+	buf = le.AppendUint64(buf, uint64(b.count))
+	buf = le.AppendUint64(buf, uint64(len(b.counters)))
+	buf = append(buf, b.counters...)
+
+	return le.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// loadBloom reads a filter written by saveBloom
+func loadBloom(path string, keys *Keyring) (*BloomIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = keys.openFile(data); err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(bloomMagic)+4 {
+		return nil, ErrCorrupted
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, ErrChecksumMismatch
+	}
+	if !bytes.HasPrefix(body, bloomMagic[:]) {
+		return nil, ErrInvalidMagic
+	}
+
+	r := bytes.NewReader(body[len(bloomMagic):])
+	var capacity, count, size uint64
+	b := &BloomIndex{}
+	for _, v := range []interface{}{&capacity, &b.fpRate, &b.hashes, &count, &size} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	if size == 0 || b.hashes == 0 || size != uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: bloom filter of %d counters", ErrCorrupted, size)
+	}
+	b.counters = make([]uint8, size)
+	if _, err := io.ReadFull(r, b.counters); err != nil {
+		return nil, err
+	}
+	b.capacity = uint(capacity)
+	b.count = uint(count)
+
+	return b, nil
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomInsertRemove(t *testing.T) {
+	b := NewBloomIndexWithRate(1000, 0.01)
+
+	for i := 0; i < 1000; i++ {
+		b.Insert(fmt.Sprintf("key%d", i))
+	}
+	assert.Equal(t, uint(1000), b.Len())
+	for i := 0; i < 1000; i++ {
+		assert.True(t, b.MightContain(fmt.Sprintf("key%d", i)))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if b.MightContain(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300)
+
+	for i := 0; i < 1000; i++ {
+		b.Remove(fmt.Sprintf("key%d", i))
+	}
+	assert.Equal(t, uint(0), b.Len())
+	for i := 0; i < 1000; i++ {
+		assert.False(t, b.MightContain(fmt.Sprintf("key%d", i)))
+	}
+}
+
+func TestBloomSaveLoad(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, bloomFile)
+
+	b := NewBloomIndexWithRate(100, 0.001)
+	b.Insert("a")
+	b.Insert("b")
+	require.NoError(t, saveBloom(b, path, nil))
+
+	loaded, err := loadBloom(path, nil)
+	require.NoError(t, err)
+	assert.Equal(t, b, loaded)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	_, err = loadBloom(path, nil)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestStoreBloomTracksIndex(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	store, err := OpenWithOptions(dir, WithBloomFilter(10, 0.01))
+	require.NoError(t, err)
+
+	// Outgrowing the filter resizes it instead of letting it fill up
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("v")))
+	}
+	require.NoError(t, store.Set("key0", []byte("again")))
+	assert.Equal(t, uint(100), store.bloom.Len())
+	assert.GreaterOrEqual(t, store.bloom.Capacity(), uint(100))
+
+	for i := 50; i < 100; i++ {
+		require.NoError(t, store.Delete(fmt.Sprintf("key%d", i)))
+	}
+	assert.Equal(t, uint(50), store.bloom.Len())
+	assert.False(t, store.bloom.MightContain("key99"))
+
+	require.NoError(t, store.Compact())
+	assert.Equal(t, uint(50), store.bloom.Len())
+	require.NoError(t, store.Close())
+
+	// The filter saved with the snapshot is picked up again
+	_, err = os.Stat(filepath.Join(dir, bloomFile))
+	require.NoError(t, err)
+	store, err = OpenWithOptions(dir, WithBloomFilter(10, 0.01))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	assert.Equal(t, uint(50), store.bloom.Len())
+	assert.GreaterOrEqual(t, store.bloom.Capacity(), uint(100))
+	for i := 0; i < 50; i++ {
+		got, err := store.Get(fmt.Sprintf("key%d", i))
+		require.NoError(t, err)
+		assert.NotEmpty(t, got)
+	}
+	_, err = store.Get("key99")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
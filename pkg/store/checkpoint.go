@@ -0,0 +1,107 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint makes dir an independent copy of the store as of now without
+// copying data: it seals the active segment, hard-links every segment with
+// its hint file and every large object into dir, and writes a snapshot
+// there. Segments are never modified once sealed, nor large objects once
+// written, so the two stores cannot affect each other. dir must not exist
+// or be empty, and must be on the same file system as the store. Open it
+// with the same keyring if the store is encrypted.
+func (s *KVStore) Checkpoint(dir string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if err := ensureEmptyDir(dir); err != nil {
+		return err
+	}
+
+	segments, large, snapData, bloomData, view, err := s.checkpointState()
+	if err != nil {
+		return err
+	}
+	defer view.Release()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, segID := range segments {
+		if err := os.Link(segmentPath(s.baseDir, segID), segmentPath(dir, segID)); err != nil {
+			return fmt.Errorf("checkpoint segment %d: %w", segID, err)
+		}
+		// Hint files are likewise only ever replaced, never modified
+		err := os.Link(hintPath(s.baseDir, segID), hintPath(dir, segID))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("checkpoint hints %d: %w", segID, err)
+		}
+	}
+	for _, f := range large {
+		if err := os.Link(largePath(s.baseDir, f.version, f.gen), largePath(dir, f.version, f.gen)); err != nil {
+			return fmt.Errorf("checkpoint large object %d: %w", f.version, err)
+		}
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, snapshotFile), snapData); err != nil {
+		return fmt.Errorf("checkpoint index snapshot: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, bloomFile), bloomData); err != nil {
+		return fmt.Errorf("checkpoint bloom filter: %w", err)
+	}
+	if err := syncDir(filepath.Dir(filepath.Clean(dir))); err != nil {
+		return err
+	}
+
+	s.logger.Info("created checkpoint", "dir", dir, "segments", len(segments))
+	return nil
+}
+
+// checkpointState seals the active segment and returns the segments and
+// large objects that now hold every write, the encoded snapshot and bloom
+// filter describing them, and a snapshot that keeps them from being removed
+func (s *KVStore) checkpointState() ([]uint64, []largeFile, []byte, []byte, *Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeOffset > 0 {
+		if err := s.rotateSegment(); err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("seal active segment: %w", err)
+		}
+	}
+
+	state := s.snapshot()
+	snapData, err := s.keys.sealFile(encodeSnapshot(state))
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	bloomData, err := s.keys.sealFile(encodeBloom(s.bloom))
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+
+	segments := make([]uint64, 0, len(state.segments))
+	for _, st := range state.segments {
+		segments = append(segments, st.ID)
+	}
+	return segments, s.liveLarge(), snapData, bloomData, s.newSnapshot(), nil
+}
+
+// ensureEmptyDir fails unless dir is missing or empty
+func ensureEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s: directory is not empty", dir)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	checkpoint := dir + "-checkpoint"
+	require.NoError(t, os.RemoveAll(checkpoint))
+	defer os.RemoveAll(checkpoint)
+
+	store, err := OpenWithOptions(dir, WithSegmentSize(256))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%02d", i), bytes.Repeat([]byte("v"), 40)))
+	}
+	require.NoError(t, store.Delete("key04"))
+	want := contents(t, store)
+
+	require.NoError(t, store.Checkpoint(checkpoint))
+
+	// Segments are shared, not copied
+	segments, err := findSegments(checkpoint)
+	require.NoError(t, err)
+	require.NotEmpty(t, segments)
+	for _, segID := range segments {
+		orig, err := os.Stat(segmentPath(dir, segID))
+		require.NoError(t, err)
+		linked, err := os.Stat(segmentPath(checkpoint, segID))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(orig, linked), "segment %d", segID)
+	}
+
+	// Neither store sees what the other does from here on
+	require.NoError(t, store.Set("key00", []byte("source only")))
+	require.NoError(t, store.Delete("key01"))
+	require.NoError(t, store.Compact())
+
+	copyStore, err := Open(checkpoint)
+	require.NoError(t, err)
+	defer copyStore.Close()
+	assert.Equal(t, want, contents(t, copyStore))
+
+	require.NoError(t, copyStore.Set("key02", []byte("checkpoint only")))
+	require.NoError(t, copyStore.Compact())
+	got, err := store.Get("key02")
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("v"), 40), got)
+	got, err = store.Get("key00")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("source only"), got)
+
+	assert.Error(t, store.Checkpoint(checkpoint))
+}
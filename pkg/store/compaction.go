@@ -1,61 +1,431 @@
 package store
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-// Compact performs manual compaction
+// compactSuffix marks a compaction output that has not been swapped in yet
+const compactSuffix = ".compact"
+
+// movedRecord remembers where a live record was copied from and to. An
+// expired record has no new entry and leaves the index on swap.
+type movedRecord struct {
+	key      string
+	oldEntry IndexEntry
+	newEntry *IndexEntry
+	large    *largeFile // Resealed large object file the copy refers to
+}
+
+// Compact merges every segment, including the active one, into a single
+// new segment.
+//
+// The active segment is sealed first so that writes arriving during
+// compaction land in a segment that sorts after the merged output. Readers
+// and writers are only blocked while the active segment is sealed and while
+// the output is swapped in; the merge itself runs without holding s.mu.
 func (s *KVStore) Compact() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	_, err := s.compact(func(SegmentStats) bool { return true })
+	return err
+}
+
+// CompactGarbage merges only the sealed segments whose garbage ratio is at
+// least minRatio, plus any sealed segment with no live data left. It returns
+// the stats of the segments it picked, which is empty when nothing
+// qualified.
+func (s *KVStore) CompactGarbage(minRatio float64) ([]SegmentStats, error) {
+	return s.compact(func(st SegmentStats) bool {
+		if st.ID == s.activeSegmentID {
+			return false
+		}
+		return st.LiveBytes == 0 || st.GarbageRatio() >= minRatio
+	})
+}
+
+// compact seals the active segment and merges the segments pick selects
+func (s *KVStore) compact(pick func(SegmentStats) bool) ([]SegmentStats, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
 
-	// Find all segments
+	s.mu.Lock()
 	segments, err := findSegments(s.baseDir)
 	if err != nil {
-		return fmt.Errorf("find segments: %w", err)
+		s.mu.Unlock()
+		return nil, fmt.Errorf("find segments: %w", err)
 	}
 
-	// Remove all old segment files
+	var picked []SegmentStats
+	var inputs []uint64
+	var inputBytes uint64
 	for _, segID := range segments {
-		path := segmentPath(s.baseDir, segID)
-		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("remove segment %d: %w", segID, err)
+		st := s.segmentStats(segID)
+		if !s.isObsolete(segID) && pick(st) {
+			picked = append(picked, st)
+			inputs = append(inputs, segID)
+			inputBytes += st.LiveBytes + st.DeadBytes
+		}
+	}
+	if len(inputs) == 0 {
+		s.mu.Unlock()
+		return nil, nil
+	}
+
+	// Reserve the ID after the sealed segment for the merged output. An
+	// empty active segment gives up its own ID instead of lingering as an
+	// empty sealed segment.
+	sealedID := s.activeSegmentID
+	outputID := sealedID + 1
+	if s.activeOffset == 0 {
+		outputID = sealedID
+	}
+	if err := s.resetActiveSegment(outputID + 1); err != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("seal active segment: %w", err)
+	}
+	if outputID == sealedID {
+		s.closeReader(sealedID)
+		delete(s.segStats, sealedID)
+		if err := os.Remove(segmentPath(s.baseDir, sealedID)); err != nil {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("remove empty segment: %w", err)
 		}
+		inputs = removeID(inputs, sealedID)
+		segments = removeID(segments, sealedID)
+	}
+	s.mu.Unlock()
+
+	start := time.Now()
+	s.logger.Info("compaction started", "inputs", inputs, "output", outputID)
+	if err := s.compactSegments(inputs, segments, outputID); err != nil {
+		s.logger.Error("compaction failed", "inputs", inputs, "output", outputID, "err", err)
+		return nil, err
+	}
+
+	s.mu.RLock()
+	out := s.segmentStats(outputID)
+	s.mu.RUnlock()
+	s.logger.Info("compaction finished",
+		"inputs", inputs, "output", outputID,
+		"input_bytes", inputBytes, "output_bytes", out.LiveBytes+out.DeadBytes,
+		"duration", time.Since(start))
+
+	return picked, nil
+}
+
+// compactSegments copies the live records of inputs into segment outputID,
+// swaps it in and removes the inputs. all lists every segment that existed
+// when the inputs were chosen.
+func (s *KVStore) compactSegments(inputs, all []uint64, outputID uint64) error {
+	if len(inputs) == 0 {
+		return nil
 	}
 
-	// Create new active segment starting from 0
-	if err := s.resetActiveSegment(0); err != nil {
-		return fmt.Errorf("reset active segment: %w", err)
+	isInput := make(map[uint64]bool, len(inputs))
+	for _, segID := range inputs {
+		isInput[segID] = true
 	}
 
-	// Rewrite all live keys to the new segment
-	for key, value := range s.values {
-		rec := &Record{
-			Op:    OpSet,
-			Key:   key,
-			Value: value,
+	// A tombstone must survive if an older segment outside the merge may
+	// still hold a value it shadows
+	oldestKept := outputID
+	for _, segID := range all {
+		if !isInput[segID] && segID < oldestKept {
+			oldestKept = segID
 		}
+	}
+
+	tmpPath := segmentPath(s.baseDir, outputID) + compactSuffix
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	writer := bufio.NewWriter(out)
+
+	var moved []movedRecord
+	var hints []hintEntry
+	offset := uint64(0)
+	tombstoneBytes := uint64(0)
+	now := s.now()
+	for _, segID := range inputs {
+		err := s.scanSegment(segID, func(rec *Record, recOffset uint64) error {
+			if err := s.keys.openRecord(rec); err != nil {
+				return err
+			}
+
+			var newEntry *IndexEntry
+			tombstone := false
+			switch rec.Op {
+			case OpSet:
+				entry, ok := s.index.Get(rec.Key)
+				if !ok || entry.SegmentID != segID || entry.Offset != recOffset {
+					return nil
+				}
+				if expired(entry.ExpiresAt, now) {
+					moved = append(moved, movedRecord{key: rec.Key, oldEntry: *entry})
+					if segID < oldestKept {
+						return nil
+					}
+					// Keep shadowing older values outside the merge
+					rec = &Record{Op: OpDelete, Seq: entry.Version, Key: rec.Key}
+					tombstone = true
+					break
+				}
+				// Records from before sequence numbers existed take the
+				// version they were given on replay
+				rec.Seq = entry.Version
+				resealed, err := s.resealLarge(rec)
+				if err != nil {
+					return fmt.Errorf("reseal large object %d: %w", rec.Seq, err)
+				}
+				newEntry = &IndexEntry{
+					SegmentID:  outputID,
+					Offset:     offset,
+					ValueSize:  entry.ValueSize,
+					StoredSize: entry.StoredSize,
+					Version:    entry.Version,
+					ExpiresAt:  entry.ExpiresAt,
+				}
+				if resealed != nil {
+					newEntry.StoredSize = storedValueSize(rec)
+				}
+				moved = append(moved, movedRecord{key: rec.Key, oldEntry: *entry, newEntry: newEntry, large: resealed})
+			case OpDelete:
+				if segID < oldestKept || s.index.Contains(rec.Key) {
+					return nil
+				}
+				tombstone = true
+			default:
+				return nil
+			}
+
+			// Records are sealed again with the current key, which moves data
+			// off keys that have been rotated out
+			sealed, err := s.keys.sealRecord(rec)
+			if err != nil {
+				return err
+			}
+			size := recordSize(sealed)
+			if newEntry != nil {
+				newEntry.Size = size
+			}
+			if tombstone {
+				tombstoneBytes += uint64(size)
+			}
 
-		if err := WriteRecord(s.activeWriter, rec); err != nil {
-			return fmt.Errorf("write record: %w", err)
+			if err := WriteRecord(writer, sealed); err != nil {
+				return err
+			}
+			hints = append(hints, hintEntry{
+				Op:         rec.Op,
+				Key:        rec.Key,
+				Offset:     offset,
+				Size:       size,
+				ValueSize:  valueSize(rec),
+				StoredSize: storedValueSize(rec),
+				Seq:        rec.Seq,
+				ExpiresAt:  rec.ExpiresAt,
+			})
+			offset += uint64(size)
+			return nil
+		})
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmpPath)
+			s.removeLarge(resealedLarge(moved))
+			return fmt.Errorf("merge segment %d: %w", segID, err)
 		}
 	}
 
-	if err := s.activeWriter.Flush(); err != nil {
-		return fmt.Errorf("flush: %w", err)
+	if err := writer.Flush(); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	// Resealed large objects have to be in place before the output that
+	// refers to them
+	if err == nil && len(resealedLarge(moved)) > 0 {
+		err = syncDir(s.baseDir)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		s.removeLarge(resealedLarge(moved))
+		return fmt.Errorf("sync output: %w", err)
 	}
 
-	if err := s.activeFile.Sync(); err != nil {
-		return fmt.Errorf("sync: %w", err)
+	// Make the merged segment durable before anything is removed. An empty
+	// merge has nothing to install.
+	if offset == 0 {
+		_ = os.Remove(tmpPath)
+	} else if err := os.Rename(tmpPath, segmentPath(s.baseDir, outputID)); err != nil {
+		_ = os.Remove(tmpPath)
+		s.removeLarge(resealedLarge(moved))
+		return fmt.Errorf("install output: %w", err)
+	}
+	if err := syncDir(s.baseDir); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	if offset > 0 {
+		if err := writeHintFile(hintPath(s.baseDir, outputID), offset, hints, s.keys); err != nil {
+			s.logger.Warn("failed to write hint file", "segment", outputID, "err", err)
+		}
 	}
 
+	s.mu.Lock()
+	var outStats *SegmentStats
+	if offset > 0 {
+		// Tombstones are only retained while an older segment remains, so
+		// they count as live, as applyDelete counts them on replay
+		outStats = s.segStat(outputID)
+		outStats.LiveBytes += tombstoneBytes
+		outStats.DeadBytes += offset - tombstoneBytes
+	}
+	var discarded []largeFile
+	for _, m := range moved {
+		// Skip keys that were overwritten or deleted while merging
+		entry, ok := s.index.Get(m.key)
+		if !ok || entry.SegmentID != m.oldEntry.SegmentID || entry.Offset != m.oldEntry.Offset {
+			if m.large != nil {
+				discarded = append(discarded, *m.large)
+			}
+			continue
+		}
+		if m.newEntry == nil {
+			s.preserve(m.key)
+			s.index.Remove(m.key)
+			s.bloom.Remove(m.key)
+			s.retireLarge(&m.oldEntry)
+			continue
+		}
+		s.index.Insert(m.key, m.newEntry)
+		if m.large != nil {
+			s.replaceLarge(*m.large)
+		}
+		outStats.LiveBytes += uint64(m.newEntry.Size)
+		outStats.DeadBytes -= uint64(m.newEntry.Size)
+	}
+	for _, segID := range inputs {
+		s.closeReader(segID)
+		delete(s.segStats, segID)
+	}
+	// Start the filter over now and then: counters that saturated never
+	// come down again
+	s.rebuildBloom(s.bloom.Capacity())
+	// Remove inputs oldest first: after a crash the survivors are always the
+	// newest inputs, which replay correctly underneath the merged output.
+	// Inputs pinned by a snapshot wait for it to be released.
+	s.obsolete = append(s.obsolete, inputs...)
+	s.mu.Unlock()
+	s.removeLarge(discarded)
+
+	if err := s.removeObsolete(); err != nil {
+		return err
+	}
+	s.removeRetired()
+
 	// Save snapshot after compaction
-	snapshotPath := filepath.Join(s.baseDir, snapshotFile)
-	if err := SaveSnapshot(s.index, snapshotPath); err != nil {
+	if err := s.SaveSnapshot(); err != nil {
 		return fmt.Errorf("save snapshot: %w", err)
 	}
 
 	return nil
 }
+
+// resealedLarge returns the large object files compaction resealed for the
+// records in moved
+func resealedLarge(moved []movedRecord) []largeFile {
+	var files []largeFile
+	for _, m := range moved {
+		if m.large != nil {
+			files = append(files, *m.large)
+		}
+	}
+	return files
+}
+
+// scanSegment calls fn for every committed record in a sealed segment along
+// with the record's offset
+func (s *KVStore) scanSegment(segID uint64, fn func(rec *Record, offset uint64) error) error {
+	file, err := os.Open(segmentPath(s.baseDir, segID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := newSizedReader(file, -1)
+	if err != nil {
+		return err
+	}
+	_, _, err = scanCommitted(r, fn)
+	return err
+}
+
+// removeStaleFiles deletes outputs of a compaction that crashed before its
+// swap, half-written hint files, hints whose segment is gone and large
+// objects that were never installed
+func removeStaleFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, largePrefix) && strings.HasSuffix(name, largeTmpSuffix) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(name, segmentPrefix) {
+			continue
+		}
+
+		stale := strings.HasSuffix(name, segmentSuffix+compactSuffix) ||
+			strings.HasSuffix(name, hintSuffix+".tmp")
+		if strings.HasSuffix(name, hintSuffix) {
+			segName := strings.TrimSuffix(name, hintSuffix) + segmentSuffix
+			if _, err := os.Stat(filepath.Join(dir, segName)); os.IsNotExist(err) {
+				stale = true
+			}
+		}
+
+		if stale {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeID returns ids without id
+func removeID(ids []uint64, id uint64) []uint64 {
+	out := ids[:0:0]
+	for _, v := range ids {
+		if v != id {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// syncDir flushes directory metadata so renames and removals are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionDropsDeletedKeys(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	store.maxSegmentSize = 512
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%03d", i), []byte("old")))
+	}
+	for i := 0; i < 100; i += 2 {
+		require.NoError(t, store.Delete(fmt.Sprintf("key%03d", i)))
+	}
+	for i := 1; i < 100; i += 2 {
+		require.NoError(t, store.Set(fmt.Sprintf("key%03d", i), []byte("new")))
+	}
+
+	require.NoError(t, store.Compact())
+	assert.Equal(t, 50, store.Stats().NumKeys)
+
+	// Deleted keys must stay deleted after replaying the merged segment
+	require.NoError(t, store.Close())
+	store, err := Open(dir)
+	require.NoError(t, err)
+
+	assert.Len(t, store.ListKeys(), 50)
+	_, err = store.Get("key000")
+	assert.Equal(t, ErrNotFound, err)
+	val, err := store.Get("key001")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), val)
+}
+
+func TestCompactionWithConcurrentWrites(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	store.maxSegmentSize = 1024
+
+	for i := 0; i < 200; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%03d", i), []byte("v1")))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, store.Set(fmt.Sprintf("key%03d", i), []byte("v2")))
+			if i%10 == 0 {
+				assert.NoError(t, store.Delete(fmt.Sprintf("key%03d", i)))
+			}
+		}
+	}()
+
+	require.NoError(t, store.Compact())
+	wg.Wait()
+
+	check := func() {
+		for i := 0; i < 200; i++ {
+			val, err := store.Get(fmt.Sprintf("key%03d", i))
+			if i%10 == 0 {
+				assert.Equal(t, ErrNotFound, err)
+				continue
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []byte("v2"), val)
+		}
+	}
+	check()
+
+	require.NoError(t, store.Close())
+	store, err := Open(dir)
+	require.NoError(t, err)
+	check()
+}
+
+func TestOpenRemovesUnfinishedCompaction(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.Set("key", []byte("value")))
+	require.NoError(t, store.Close())
+
+	leftover := segmentPath(dir, 99) + compactSuffix
+	require.NoError(t, os.WriteFile(leftover, []byte("partial"), 0644))
+
+	store, err := Open(dir)
+	require.NoError(t, err)
+
+	_, err = os.Stat(leftover)
+	assert.True(t, os.IsNotExist(err))
+
+	val, err := store.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestSegmentGarbageAccounting(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.Set("a", []byte("1")))
+	require.NoError(t, store.Set("b", []byte("2")))
+	seg := store.segmentStats(store.activeSegmentID)
+	assert.Equal(t, uint64(0), seg.DeadBytes)
+	assert.Greater(t, seg.LiveBytes, uint64(0))
+
+	// Overwriting retires the old record, deleting retires it plus the tombstone
+	require.NoError(t, store.Set("a", []byte("3")))
+	require.NoError(t, store.Delete("b"))
+	seg = store.segmentStats(store.activeSegmentID)
+	entry, _ := store.index.Get("a")
+	assert.Equal(t, uint64(entry.Size), seg.LiveBytes)
+	assert.InDelta(t, 0.75, seg.GarbageRatio(), 0.05)
+
+	// Replay rebuilds the same breakdown
+	segID := store.activeSegmentID
+	require.NoError(t, store.Close())
+	store, err := Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, seg, store.segmentStats(segID))
+}
+
+func TestCompactGarbagePicksDirtySegments(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	// Segment with only live data
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("keep%d", i), []byte("value")))
+	}
+	cleanID := store.activeSegmentID
+	require.NoError(t, store.rotateSegment())
+
+	// Segment that is mostly overwritten
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, store.Set(fmt.Sprintf("churn%d", i), []byte("value")))
+		}
+	}
+	dirtyID := store.activeSegmentID
+	require.NoError(t, store.rotateSegment())
+
+	compacted, err := store.CompactGarbage(0.5)
+	require.NoError(t, err)
+	require.Len(t, compacted, 1)
+	assert.Equal(t, dirtyID, compacted[0].ID)
+	assert.GreaterOrEqual(t, compacted[0].GarbageRatio(), 0.5)
+
+	stats := store.Stats()
+	var ids []uint64
+	for _, seg := range stats.Segments {
+		ids = append(ids, seg.ID)
+		assert.Less(t, seg.GarbageRatio(), 0.5)
+	}
+	assert.Contains(t, ids, cleanID)
+	assert.NotContains(t, ids, dirtyID)
+
+	for i := 0; i < 10; i++ {
+		_, err := store.Get(fmt.Sprintf("churn%d", i))
+		require.NoError(t, err)
+	}
+
+	// Nothing left to do
+	compacted, err = store.CompactGarbage(0.5)
+	require.NoError(t, err)
+	assert.Empty(t, compacted)
+}
+
+func TestRetainedTombstoneStatsSurviveReopen(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("keep%d", i), []byte("value")))
+	}
+	require.NoError(t, store.rotateSegment())
+
+	// The tombstone has to outlive the merge to keep shadowing keep0
+	for round := 0; round < 5; round++ {
+		require.NoError(t, store.Set("churn", []byte("value")))
+	}
+	require.NoError(t, store.Delete("keep0"))
+	require.NoError(t, store.rotateSegment())
+
+	compacted, err := store.CompactGarbage(0.5)
+	require.NoError(t, err)
+	require.Len(t, compacted, 1)
+	outputID := store.activeSegmentID - 1
+	before := store.Stats().Segments
+	assert.Zero(t, store.segmentStats(outputID).DeadBytes)
+
+	// Replay and hints have to arrive at the same numbers without the
+	// snapshot's copy of them
+	require.NoError(t, store.Close())
+	require.NoError(t, os.Remove(filepath.Join(dir, snapshotFile)))
+	store, err = Open(dir)
+	require.NoError(t, err)
+	for _, seg := range before {
+		assert.Equal(t, seg, store.segmentStats(seg.ID))
+	}
+
+	// Rewriting the merged segment would only keep the same tombstone
+	compacted, err = store.CompactGarbage(0.5)
+	require.NoError(t, err)
+	for _, seg := range compacted {
+		assert.NotEqual(t, outputID, seg.ID)
+	}
+
+	_, err = store.Get("keep0")
+	assert.Equal(t, ErrNotFound, err)
+}
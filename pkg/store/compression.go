@@ -0,0 +1,158 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression selects the codec applied to record values
+type Compression byte
+
+const (
+	// CompressionNone stores values as they are
+	CompressionNone Compression = iota
+	// CompressionDeflate compresses values with DEFLATE (RFC 1951)
+	CompressionDeflate
+)
+
+// Values shorter than this are never worth compressing
+const minCompressSize = 64
+
+// codec compresses and decompresses record values. New codecs only need an
+// entry in codecs; the record header already carries the codec ID.
+type codec struct {
+	encode func(src []byte) ([]byte, error)
+	decode func(src []byte, size uint32) ([]byte, error)
+}
+
+var codecs = map[Compression]codec{
+	CompressionDeflate: {encode: deflateEncode, decode: deflateDecode},
+}
+
+// String returns the name used by ParseCompression
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("Compression(%d)", byte(c))
+	}
+}
+
+// ParseCompression returns the codec with the given name ("none" or
+// "deflate")
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "none", "":
+		return CompressionNone, nil
+	case "deflate":
+		return CompressionDeflate, nil
+	default:
+		return CompressionNone, fmt.Errorf("unknown compression %q (want none or deflate)", name)
+	}
+}
+
+// compressRecord returns rec with its value compressed by c, or rec itself
+// if compression would not make the value smaller
+func compressRecord(rec *Record, c Compression) *Record {
+	codec, ok := codecs[c]
+	if !ok || !hasValue(rec.Op) || len(rec.Value) < minCompressSize {
+		return rec
+	}
+
+	encoded, err := codec.encode(rec.Value)
+	if err != nil || len(encoded) >= len(rec.Value) {
+		return rec
+	}
+
+	out := *rec
+	out.Value = encoded
+	out.Codec = c
+	out.RawSize = uint32(len(rec.Value))
+	return &out
+}
+
+// decompressRecord replaces a compressed value with its decoded form
+func decompressRecord(rec *Record) error {
+	if rec.Codec == CompressionNone {
+		return nil
+	}
+
+	codec, ok := codecs[rec.Codec]
+	if !ok {
+		return fmt.Errorf("%w: unknown codec %d", ErrCorrupted, rec.Codec)
+	}
+	value, err := codec.decode(rec.Value, rec.RawSize)
+	if err != nil {
+		return fmt.Errorf("%w: decode %s value: %v", ErrCorrupted, rec.Codec, err)
+	}
+
+	rec.Value = value
+	rec.Codec = CompressionNone
+	rec.RawSize = 0
+	return nil
+}
+
+// valueSize returns the decoded length of a record's value, or of the
+// large object it refers to, capped at the largest uint32
+func valueSize(rec *Record) uint32 {
+	if rec.Large {
+		if obj, err := decodeLargeObject(rec.Value); err == nil {
+			return clampSize(obj.size)
+		}
+	}
+	if rec.Codec != CompressionNone {
+		return rec.RawSize
+	}
+	return uint32(len(rec.Value))
+}
+
+// storedValueSize returns the number of bytes a record's value takes up on
+// disk, counting the file of a large object, capped at the largest uint32
+func storedValueSize(rec *Record) uint32 {
+	if rec.Large {
+		if obj, err := decodeLargeObject(rec.Value); err == nil {
+			return clampSize(obj.stored)
+		}
+	}
+	return uint32(len(rec.Value))
+}
+
+// flate writers are large, so they are reused
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+func deflateEncode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func deflateDecode(src []byte, size uint32) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	value := make([]byte, size)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
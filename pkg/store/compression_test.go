@@ -0,0 +1,81 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCompression(t *testing.T) {
+	c, err := ParseCompression("deflate")
+	require.NoError(t, err)
+	assert.Equal(t, CompressionDeflate, c)
+	c, err = ParseCompression("")
+	require.NoError(t, err)
+	assert.Equal(t, CompressionNone, c)
+	_, err = ParseCompression("lz4")
+	assert.Error(t, err)
+}
+
+func TestCompression(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	defer os.RemoveAll(dir)
+
+	// Start uncompressed so the segment mixes both kinds of record
+	store, err := Open(dir)
+	require.NoError(t, err)
+	plain := []byte(`{"kind":"plain"}`)
+	require.NoError(t, store.Set("plain", plain))
+	require.NoError(t, store.Close())
+
+	store, err = OpenWithOptions(dir, WithCompression(CompressionDeflate))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	doc := bytes.Repeat([]byte(`{"level":"info","msg":"request served"}`), 100)
+	require.NoError(t, store.Set("log", doc))
+	small := []byte("tiny")
+	require.NoError(t, store.Set("small", small))
+	b := NewBatch()
+	for i := 0; i < 3; i++ {
+		b.Set(fmt.Sprintf("batch%d", i), doc)
+	}
+	require.NoError(t, store.Write(b))
+
+	entry, ok := store.index.Get("log")
+	require.True(t, ok)
+	assert.Equal(t, uint32(len(doc)), entry.ValueSize)
+	assert.Less(t, entry.StoredSize, entry.ValueSize)
+
+	stats := store.Stats()
+	assert.Greater(t, stats.CompressionRatio(), 5.0)
+
+	check := func() {
+		for key, want := range map[string][]byte{
+			"plain": plain, "log": doc, "small": small, "batch2": doc,
+		} {
+			val, err := store.Get(key)
+			require.NoError(t, err, key)
+			assert.Equal(t, want, val, key)
+		}
+	}
+	check()
+
+	// Compressed records survive replay, hints and compaction as they are
+	require.NoError(t, store.Close())
+	store, err = Open(dir)
+	require.NoError(t, err)
+	check()
+	require.NoError(t, store.Compact())
+	check()
+	entry, ok = store.index.Get("log")
+	require.True(t, ok)
+	assert.Less(t, entry.StoredSize, entry.ValueSize)
+	assert.InDelta(t, stats.CompressionRatio(), store.Stats().CompressionRatio(), 0.001)
+}
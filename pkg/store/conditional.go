@@ -0,0 +1,96 @@
+package store
+
+import "fmt"
+
+// Versions passed to and returned by the conditional operations are the
+// sequence numbers of the writes that stored each value. They increase
+// monotonically across the whole store. Version 0 stands for a missing or
+// expired key.
+
+// GetWithVersion retrieves a value by key along with its version
+func (s *KVStore) GetWithVersion(key string) ([]byte, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.lookup(key)
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+
+	value, err := s.readValue(key, entry)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, entry.Version, nil
+}
+
+// SetIfVersion stores a value only if the key is currently at the given
+// version, and returns the key's new version
+func (s *KVStore) SetIfVersion(key string, value []byte, version uint64) (uint64, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	s.mu.Lock()
+	if err := s.checkVersion(key, version); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	ticket, err := s.set(key, value, 0)
+	newVersion := s.seq
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.waitDurable(ticket); err != nil {
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+// SetIfAbsent stores a value only if the key does not exist, and returns
+// the key's new version
+func (s *KVStore) SetIfAbsent(key string, value []byte) (uint64, error) {
+	return s.SetIfVersion(key, value, 0)
+}
+
+// DeleteIfVersion removes a key only if it is currently at the given
+// version. Deleting a missing or expired key at version 0 succeeds without
+// writing.
+func (s *KVStore) DeleteIfVersion(key string, version uint64) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	s.mu.Lock()
+	if err := s.checkVersion(key, version); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if version == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	ticket, err := s.delete(key)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.waitDurable(ticket)
+}
+
+// checkVersion fails with ErrVersionMismatch unless key is at version;
+// callers hold s.mu
+func (s *KVStore) checkVersion(key string, version uint64) error {
+	current := uint64(0)
+	if entry, ok := s.lookup(key); ok {
+		current = entry.Version
+	}
+	if current != version {
+		return fmt.Errorf("%w: key %q is at version %d, expected %d", ErrVersionMismatch, key, current, version)
+	}
+	return nil
+}
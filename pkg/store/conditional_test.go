@@ -0,0 +1,127 @@
+package store
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	v1, err := store.SetIfAbsent("lease", []byte("a"))
+	require.NoError(t, err)
+	assert.NotZero(t, v1)
+
+	_, err = store.SetIfAbsent("lease", []byte("b"))
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+
+	v2, err := store.SetIfVersion("lease", []byte("b"), v1)
+	require.NoError(t, err)
+	assert.Greater(t, v2, v1)
+
+	// A stale version loses the race
+	_, err = store.SetIfVersion("lease", []byte("c"), v1)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	assert.ErrorIs(t, store.DeleteIfVersion("lease", v1), ErrVersionMismatch)
+
+	val, version, err := store.GetWithVersion("lease")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b"), val)
+	assert.Equal(t, v2, version)
+
+	// Plain writes bump the version too
+	require.NoError(t, store.Set("lease", []byte("d")))
+	_, v3, err := store.GetWithVersion("lease")
+	require.NoError(t, err)
+	assert.Greater(t, v3, v2)
+
+	// Versions survive a restart, and new writes keep counting upwards
+	require.NoError(t, store.Close())
+	store, err = Open(dir)
+	require.NoError(t, err)
+	_, version, err = store.GetWithVersion("lease")
+	require.NoError(t, err)
+	assert.Equal(t, v3, version)
+
+	require.NoError(t, store.DeleteIfVersion("lease", v3))
+	_, _, err = store.GetWithVersion("lease")
+	assert.Equal(t, ErrNotFound, err)
+	require.NoError(t, store.DeleteIfVersion("lease", 0))
+
+	v4, err := store.SetIfAbsent("lease", []byte("e"))
+	require.NoError(t, err)
+	assert.Greater(t, v4, v3)
+}
+
+func TestVersionsAfterCompaction(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.Set("a", []byte("1")))
+	require.NoError(t, store.Set("b", []byte("2")))
+	require.NoError(t, store.Set("a", []byte("3")))
+	_, before, err := store.GetWithVersion("a")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Compact())
+	_, after, err := store.GetWithVersion("a")
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	require.NoError(t, store.Close())
+	store, err = Open(dir)
+	require.NoError(t, err)
+	_, after, err = store.GetWithVersion("a")
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestReadsVersion1Records(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	// A segment written before records carried sequence numbers
+	var data []byte
+	for _, rec := range []*Record{
+		{Op: OpSet, Key: "old", Value: []byte("v1")},
+		{Op: OpSet, Key: "gone", Value: []byte("x")},
+		{Op: OpDelete, Key: "gone"},
+	} {
+		data = append(data, encodeRecordV1(rec)...)
+	}
+	require.NoError(t, os.WriteFile(segmentPath(dir, 1), data, 0644))
+
+	store, err := Open(dir)
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	val, version, err := store.GetWithVersion("old")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	assert.NotZero(t, version)
+	_, err = store.Get("gone")
+	assert.Equal(t, ErrNotFound, err)
+
+	newVersion, err := store.SetIfVersion("old", []byte("v2"), version)
+	require.NoError(t, err)
+	assert.Greater(t, newVersion, uint64(3))
+}
+
+// encodeRecordV1 encodes a record in the version 1 format
+func encodeRecordV1(rec *Record) []byte {
+	buf := append([]byte{}, Magic[:]...)
+	buf = append(buf, rec.Op)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(rec.Key)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(rec.Value)))
+	buf = append(buf, rec.Key...)
+	buf = append(buf, rec.Value...)
+	return binary.LittleEndian.AppendUint32(buf, computeChecksumV1(rec))
+}
@@ -0,0 +1,240 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const nonceSize = 12
+
+// Files other than segments (hints, the index snapshot) are sealed whole
+// and start with this magic, followed by the key ID and nonce
+var sealedFileMagic = [8]byte{'K', 'V', 'S', 'E', 'A', 'L', '0', '1'}
+
+// EncryptionKey is an AES key and the ID recorded with everything sealed
+// by it
+type EncryptionKey struct {
+	ID  uint32 // Must be non-zero
+	Key []byte // 16, 24 or 32 bytes for AES-128, AES-192 or AES-256
+}
+
+// Keyring holds the keys a store encrypts and decrypts with. New data is
+// sealed with AES-GCM under the key with the highest ID; older keys only
+// need to stay in the ring until compaction has rewritten the data sealed
+// with them.
+type Keyring struct {
+	activeID uint32
+	aeads    map[uint32]cipher.AEAD
+}
+
+// NewKeyring builds a keyring from one or more keys
+func NewKeyring(keys ...EncryptionKey) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring needs at least one key")
+	}
+
+	k := &Keyring{aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		if key.ID == 0 {
+			return nil, fmt.Errorf("key ID 0 is reserved for unencrypted data")
+		}
+		if _, dup := k.aeads[key.ID]; dup {
+			return nil, fmt.Errorf("duplicate key ID %d", key.ID)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", key.ID, err)
+		}
+		k.aeads[key.ID] = aead
+		if key.ID > k.activeID {
+			k.activeID = key.ID
+		}
+	}
+
+	return k, nil
+}
+
+// ParseKeyring builds a keyring from "<id>:<hex key>" entries separated by
+// commas or newlines. Blank lines and lines starting with # are ignored.
+func ParseKeyring(text string) (*Keyring, error) {
+	var keys []EncryptionKey
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' })
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		idStr, keyHex, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("key entry %q is not <id>:<hex key>", field)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("key ID %q: %w", idStr, err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(keyHex))
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		keys = append(keys, EncryptionKey{ID: uint32(id), Key: key})
+	}
+
+	return NewKeyring(keys...)
+}
+
+// LoadKeyring reads a key file in the format ParseKeyring accepts
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(data))
+}
+
+// ActiveID returns the ID of the key new data is sealed with
+func (k *Keyring) ActiveID() uint32 {
+	return k.activeID
+}
+
+// aead returns the cipher for a key ID. A nil keyring has no keys.
+func (k *Keyring) aead(id uint32) (cipher.AEAD, error) {
+	if k != nil {
+		if aead, ok := k.aeads[id]; ok {
+			return aead, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: key ID %d", ErrMissingKey, id)
+}
+
+// sealRecord returns a copy of rec with its key and value encrypted under
+// the active key, or rec itself if k is nil. Batch markers hold no user
+// data and are left alone.
+func (k *Keyring) sealRecord(rec *Record) (*Record, error) {
+	if k == nil || (rec.Op != OpSet && rec.Op != OpDelete && rec.Op != OpChunk) {
+		return rec, nil
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := *rec
+	out.KeyID = k.activeID
+	out.Nonce = nonce
+
+	plaintext := make([]byte, 0, len(rec.Key)+len(rec.Value))
+	plaintext = append(append(plaintext, rec.Key...), rec.Value...)
+	sealed := k.aeads[k.activeID].Seal(nil, nonce, plaintext, recordAAD(&out))
+
+	// The ciphertext of the key takes the key's place; the rest, including
+	// the authentication tag, takes the value's
+	out.Key = string(sealed[:len(rec.Key)])
+	out.Value = sealed[len(rec.Key):]
+	return &out, nil
+}
+
+// openRecord decrypts a record read from disk in place. Unencrypted
+// records are left alone.
+func (k *Keyring) openRecord(rec *Record) error {
+	if rec.KeyID == 0 {
+		return nil
+	}
+
+	aead, err := k.aead(rec.KeyID)
+	if err != nil {
+		return err
+	}
+	if len(rec.Nonce) != aead.NonceSize() || len(rec.Value) < aead.Overhead() {
+		return ErrCorrupted
+	}
+
+	sealed := make([]byte, 0, len(rec.Key)+len(rec.Value))
+	sealed = append(append(sealed, rec.Key...), rec.Value...)
+	plaintext, err := aead.Open(nil, rec.Nonce, sealed, recordAAD(rec))
+	if err != nil {
+		return fmt.Errorf("%w: decrypt record: %v", ErrCorrupted, err)
+	}
+
+	keyLen := len(rec.Key)
+	rec.Key = string(plaintext[:keyLen])
+	rec.Value = nil
+	if len(plaintext) > keyLen {
+		rec.Value = plaintext[keyLen:]
+	}
+	rec.KeyID = 0
+	rec.Nonce = nil
+	return nil
+}
+
+// recordAAD binds the unencrypted header fields of a record to its
+// ciphertext
+func recordAAD(rec *Record) []byte {
+	aad := []byte{rec.Op, byte(rec.Codec)}
+	aad = binary.LittleEndian.AppendUint64(aad, rec.Seq)
+	aad = binary.LittleEndian.AppendUint64(aad, uint64(rec.ExpiresAt))
+	aad = binary.LittleEndian.AppendUint32(aad, rec.RawSize)
+	aad = binary.LittleEndian.AppendUint32(aad, rec.KeyID)
+	// Records from before large objects existed have nothing more to bind
+	if rec.Large {
+		aad = append(aad, flagLarge)
+	}
+	return aad
+}
+
+// sealFile encrypts the contents of a whole file under the active key, or
+// returns data unchanged if k is nil
+func (k *Keyring) sealFile(data []byte) ([]byte, error) {
+	if k == nil {
+		return data, nil
+	}
+
+	header := make([]byte, 0, len(sealedFileMagic)+4+nonceSize)
+	header = append(header, sealedFileMagic[:]...)
+	header = binary.LittleEndian.AppendUint32(header, k.activeID)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+
+	return k.aeads[k.activeID].Seal(header, nonce, data, header[:len(sealedFileMagic)+4]), nil
+}
+
+// openFile decrypts file contents written by sealFile. Contents that were
+// never sealed are returned unchanged.
+func (k *Keyring) openFile(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealedFileMagic[:]) {
+		return data, nil
+	}
+
+	headerLen := len(sealedFileMagic) + 4 + nonceSize
+	if len(data) < headerLen {
+		return nil, ErrCorrupted
+	}
+	keyID := binary.LittleEndian.Uint32(data[len(sealedFileMagic):])
+	aead, err := k.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := data[len(sealedFileMagic)+4 : headerLen]
+	plaintext, err := aead.Open(nil, nonce, data[headerLen:], data[:len(sealedFileMagic)+4])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypt file: %v", ErrCorrupted, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, keys ...EncryptionKey) *Keyring {
+	k, err := NewKeyring(keys...)
+	require.NoError(t, err)
+	return k
+}
+
+func testKey(id uint32) EncryptionKey {
+	return EncryptionKey{ID: id, Key: bytes.Repeat([]byte{byte(id)}, 32)}
+}
+
+func TestParseKeyring(t *testing.T) {
+	k, err := ParseKeyring("# keys\n1:" + string(bytes.Repeat([]byte("ab"), 16)) +
+		", 3:" + string(bytes.Repeat([]byte("cd"), 32)) + "\n\n")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), k.ActiveID())
+
+	for _, text := range []string{
+		"",
+		"1",
+		"x:00112233445566778899aabbccddeeff",
+		"1:zz",
+		"1:0011",
+		"0:00112233445566778899aabbccddeeff",
+		"1:00112233445566778899aabbccddeeff,1:00112233445566778899aabbccddeeff",
+	} {
+		_, err := ParseKeyring(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	defer os.RemoveAll(dir)
+
+	keys := testKeyring(t, testKey(1))
+	store, err := OpenWithOptions(dir, WithKeyring(keys), WithCompression(CompressionDeflate))
+	require.NoError(t, err)
+
+	secret := bytes.Repeat([]byte("top-secret-value "), 10)
+	require.NoError(t, store.Set("secret-key", secret))
+	require.NoError(t, store.Set("gone", []byte("top-secret-deleted")))
+	require.NoError(t, store.Delete("gone"))
+	b := NewBatch()
+	b.Set("batch-key", []byte("top-secret-batch"))
+	require.NoError(t, store.Write(b))
+	require.NoError(t, store.SaveSnapshot())
+	require.NoError(t, store.Close())
+
+	// Neither keys nor values appear in anything written to disk
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "top-secret", f.Name())
+		assert.NotContains(t, string(data), "secret-key", f.Name())
+	}
+
+	store, err = OpenWithOptions(dir, WithKeyring(keys))
+	require.NoError(t, err)
+	got, err := store.Get("secret-key")
+	require.NoError(t, err)
+	assert.Equal(t, secret, got)
+	got, err = store.Get("batch-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("top-secret-batch"), got)
+	_, err = store.Get("gone")
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, store.Close())
+
+	// Without the key the data cannot be read
+	require.NoError(t, os.Remove(filepath.Join(dir, snapshotFile)))
+	_, err = Open(dir)
+	assert.ErrorIs(t, err, ErrMissingKey)
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	defer os.RemoveAll(dir)
+
+	// Data written before encryption was enabled is picked up too
+	store, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("p", []byte("0")))
+	require.NoError(t, store.Close())
+
+	store, err = OpenWithOptions(dir, WithKeyring(testKeyring(t, testKey(1))))
+	require.NoError(t, err)
+	require.NoError(t, store.Set("a", []byte("1")))
+	require.NoError(t, store.Set("b", []byte("2")))
+	require.NoError(t, store.Delete("b"))
+	require.NoError(t, store.Close())
+
+	store, err = OpenWithOptions(dir, WithKeyring(testKeyring(t, testKey(1), testKey(2))))
+	require.NoError(t, err)
+	require.NoError(t, store.Set("c", []byte("3")))
+	require.NoError(t, store.Compact())
+	require.NoError(t, store.Close())
+
+	// Compaction moved everything onto the new key
+	segments, err := findSegments(dir)
+	require.NoError(t, err)
+	for _, segID := range segments {
+		file, err := os.Open(segmentPath(dir, segID))
+		require.NoError(t, err)
+		_, _, err = scanCommitted(file, func(rec *Record, _ uint64) error {
+			if rec.Op == OpSet || rec.Op == OpDelete {
+				assert.Equal(t, uint32(2), rec.KeyID)
+			}
+			return nil
+		})
+		file.Close()
+		require.NoError(t, err)
+	}
+
+	store, err = OpenWithOptions(dir, WithKeyring(testKeyring(t, testKey(2))))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+	for key, want := range map[string]string{"p": "0", "a": "1", "c": "3"} {
+		got, err := store.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(got))
+	}
+	_, err = store.Get("b")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -2,8 +2,11 @@ package store
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
@@ -23,39 +26,143 @@ const (
 type KVStore struct {
 	mu sync.RWMutex
 
-	baseDir          string
-	values           map[string][]byte
-	index            *Index
-	bloom            *BloomIndex
-	activeSegmentID  uint64
-	activeWriter     *bufio.Writer
-	activeFile       *os.File
-	maxSegmentSize   uint64
+	// Serialises compactions; never held together with mu while merging
+	compactMu sync.Mutex
+
+	baseDir         string
+	index           *Index
+	bloom           *BloomIndex
+	activeSegmentID uint64
+	activeWriter    *bufio.Writer
+	activeFile      *os.File
+	activeOffset    uint64
+	activeHints     []hintEntry
+	maxSegmentSize  uint64
+
+	// Codec applied to values written from now on
+	compression Compression
+
+	// Set for stores opened with WithReadOnly, which reject every write
+	readOnly bool
+
+	logger *slog.Logger
+
+	// Keys records and index files are encrypted with; nil for plaintext
+	keys *Keyring
+
+	// Source of the current time for expiring keys
+	now func() time.Time
+
+	// Sequence number of the latest write, guarded by mu. Every set and
+	// delete takes the next one, which becomes the key's version.
+	seq uint64
+
+	// Live and dead byte counts per segment, guarded by mu
+	segStats map[uint64]*SegmentStats
+
+	// Durability: written counts appended records (guarded by mu) and
+	// serves as the ticket writers wait on for group commit
+	syncPolicy SyncPolicy
+	commits    *groupCommit
+	written    uint64
+	stopSync   chan struct{}
+	syncWG     sync.WaitGroup
+
+	// Read handles for segment files, opened lazily
+	readersMu sync.Mutex
+	readers   map[uint64]*os.File
+
+	// Open snapshots and the segments they pin, guarded by mu. Compacted
+	// segments wait in obsolete, in retirement order, until no snapshot
+	// pins them; removeMu serialises their removal.
+	snapshots map[*Snapshot]struct{}
+	pins      map[uint64]int
+	obsolete  []uint64
+	removeMu  sync.Mutex
+
+	// Held on baseDir while the store is open for writing
+	lock *dirLock
+
+	// Consumers of Watch and WatchFrom, guarded by mu
+	watchers map[*watcher]struct{}
+
+	// Generations of the large objects the index refers to, by version,
+	// and files replaced or deleted but not yet removed; guarded by mu.
+	// Values longer than largeThreshold that arrive through PutReader
+	// become large objects.
+	large          map[uint64]uint32
+	retired        []retiredLarge
+	largeThreshold uint64
+
+	// Segments a read-only store has replayed. Its activeSegmentID and
+	// activeOffset track how far into the writer's newest segment it got.
+	followed []uint64
 }
 
 // Open opens or creates a KVStore at the given directory
 func Open(dir string) (*KVStore, error) {
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	return OpenWithOptions(dir)
+}
+
+// OpenWithOptions opens or creates a KVStore at the given directory with
+// the given options applied over the defaults
+func OpenWithOptions(dir string, opts ...Option) (store *KVStore, err error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
 		return nil, err
 	}
 
-	store := &KVStore{
+	// Create directory if it doesn't exist, and keep any other writer out
+	// of it. Read-only stores change nothing, so they share it freely.
+	var lock *dirLock
+	if !o.readOnly {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if lock, err = lockDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	store = &KVStore{
 		baseDir:        dir,
-		values:         make(map[string][]byte),
 		index:          NewIndex(),
-		bloom:          NewBloomIndex(50000),
-		maxSegmentSize: 16 * 1024 * 1024, // 16 MB
-	}
-
-	// Try to load snapshot first
-	snapshotPath := filepath.Join(dir, snapshotFile)
-	if _, err := os.Stat(snapshotPath); err == nil {
-		if idx, err := LoadSnapshot(snapshotPath); err == nil {
-			store.index = idx
-			fmt.Printf("✓ Loaded index from snapshot (%d keys)\n", idx.Len())
-		} else {
-			fmt.Printf("⚠ Failed to load snapshot: %v, rebuilding from segments\n", err)
+		bloom:          NewBloomIndexWithRate(o.bloomExpectedKeys, o.bloomFPRate),
+		maxSegmentSize: o.segmentSize,
+		readers:        make(map[uint64]*os.File),
+		segStats:       make(map[uint64]*SegmentStats),
+		syncPolicy:     o.syncPolicy,
+		compression:    o.compression,
+		keys:           o.keyring,
+		readOnly:       o.readOnly,
+		logger:         o.logger,
+		commits:        newGroupCommit(),
+		now:            o.clock,
+		snapshots:      make(map[*Snapshot]struct{}),
+		pins:           make(map[uint64]int),
+		watchers:       make(map[*watcher]struct{}),
+		large:          make(map[uint64]uint32),
+		largeThreshold: o.largeThreshold,
+		lock:           lock,
+	}
+	// A store that fails to open lets go of everything it got hold of
+	defer func(s *KVStore) {
+		if err != nil {
+			s.closeReaders()
+			if s.activeFile != nil {
+				_ = s.activeFile.Close()
+			}
+			_ = lock.release()
+		}
+	}(store)
+
+	// Discard output of a compaction that never completed its swap
+	if !store.readOnly {
+		if err := removeStaleFiles(dir); err != nil {
+			return nil, err
 		}
 	}
 
@@ -65,17 +172,36 @@ func Open(dir string) (*KVStore, error) {
 		return nil, err
 	}
 
+	// Start from the snapshot if it still matches the segments on disk, so
+	// only what was written after it needs replaying
+	snap := store.loadSnapshot(segments)
+	if snap != nil {
+		store.loadBloom(o)
+	}
+
 	// Replay segments
+	var fromSeg, fromOffset uint64
+	if snap != nil {
+		fromSeg, fromOffset = snap.segment, snap.offset
+	}
 	start := time.Now()
-	for _, segID := range segments {
-		path := segmentPath(dir, segID)
-		if err := store.replaySegment(path, segID); err != nil {
-			return nil, fmt.Errorf("replay segment %d: %w", segID, err)
-		}
+	end, err := store.replay(segments, fromSeg, fromOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	store.logger.Info("replayed segments",
+		"dir", dir, "segments", len(segments), "keys", store.index.Len(), "duration", time.Since(start))
+
+	// A read-only store has no segment of its own; it remembers how far
+	// it got in the writer's so Refresh can carry on from there
+	if store.readOnly {
+		store.follow(segments, end)
+		return store, nil
 	}
 
-	if len(segments) > 0 && store.index.IsEmpty() {
-		fmt.Printf("✓ Rebuilt index from segments in %.2fs\n", time.Since(start).Seconds())
+	if err := store.loadLarge(); err != nil {
+		return nil, err
 	}
 
 	// Determine next segment ID
@@ -90,51 +216,178 @@ func Open(dir string) (*KVStore, error) {
 		return nil, err
 	}
 
+	if store.syncPolicy.Mode == SyncInterval {
+		store.stopSync = make(chan struct{})
+		store.syncWG.Add(1)
+		go store.runIntervalSync(store.syncPolicy.Interval, store.stopSync)
+	}
+
 	return store, nil
 }
 
-// Set stores or updates a key-value pair
-func (s *KVStore) Set(key string, value []byte) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// replay applies segments to the in-memory structures, skipping those
+// before fromSeg and the records before fromOffset within it. It returns
+// the offset replay reached in the last segment.
+func (s *KVStore) replay(segments []uint64, fromSeg, fromOffset uint64) (uint64, error) {
+	end := fromOffset
+	for i, segID := range segments {
+		if segID < fromSeg {
+			continue
+		}
+		var from uint64
+		if segID == fromSeg {
+			from = fromOffset
+		}
 
-	rec := &Record{
-		Op:    OpSet,
-		Key:   key,
-		Value: value,
+		// Sealed segments usually have a hint file, which is far cheaper
+		// to replay than the segment itself
+		hints, err := loadSegmentHints(s.baseDir, segID, s.keys)
+		if err == nil {
+			hints = hintsFrom(hints, from)
+			if err := s.replayHints(segID, hints); err != nil {
+				return 0, fmt.Errorf("replay hints %d: %w", segID, err)
+			}
+			s.logger.Debug("replayed segment", "segment", segID, "source", "hints", "records", len(hints))
+			end = from
+			if n := len(hints); n > 0 {
+				end = hints[n-1].Offset + uint64(hints[n-1].Size)
+			}
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn("ignoring hint file", "segment", segID, "err", err)
+		}
+
+		path := segmentPath(s.baseDir, segID)
+		hints, validSize, damageAt, err := s.replaySegment(path, segID, from)
+		end = validSize
+		if err != nil {
+			// A crash mid-write can only tear the tail of the newest segment
+			if i != len(segments)-1 || !isTornWrite(err) {
+				return 0, fmt.Errorf("replay segment %d: %w", segID, err)
+			}
+			// A read-only store leaves the tail for the writer to repair
+			// and just stops short of it
+			if s.readOnly {
+				s.logger.Warn("ignoring torn segment tail", "segment", segID, "offset", validSize, "err", err)
+				continue
+			}
+			discarded, tornErr := truncateTornTail(path, validSize, damageAt)
+			if tornErr != nil {
+				return 0, fmt.Errorf("replay segment %d: %w (%v)", segID, err, tornErr)
+			}
+			s.logger.Warn("truncated torn segment tail",
+				"segment", segID, "offset", validSize, "discarded", discarded, "err", err)
+		}
+		s.logger.Debug("replayed segment", "segment", segID, "source", "segment", "records", len(hints), "bytes", validSize)
+
+		// Every replayed segment is sealed from here on, so give it a hint
+		// file for the next restart. Hints for part of a segment would be
+		// mistaken for all of it.
+		if s.readOnly || from > 0 {
+			continue
+		}
+		if err := writeHintFile(hintPath(s.baseDir, segID), validSize, hints, s.keys); err != nil {
+			s.logger.Warn("failed to write hint file", "segment", segID, "err", err)
+		}
 	}
 
-	if err := WriteRecord(s.activeWriter, rec); err != nil {
-		return err
+	return end, nil
+}
+
+// loadSnapshot restores the index, sequence and segment counters from the
+// index snapshot and returns it, or returns nil if there is no snapshot
+// that covers the given segments
+func (s *KVStore) loadSnapshot(segments []uint64) *indexSnapshot {
+	snap, err := readSnapshotFile(filepath.Join(s.baseDir, snapshotFile), s.keys)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn("failed to load index snapshot, rebuilding from segments", "err", err)
+		}
+		return nil
+	}
+	if !snap.covers(s.baseDir, segments) {
+		s.logger.Info("index snapshot is out of date, rebuilding from segments")
+		return nil
 	}
 
-	if err := s.activeWriter.Flush(); err != nil {
-		return err
+	s.index = snap.index
+	s.seq = snap.seq
+	for i := range snap.segments {
+		st := snap.segments[i]
+		s.segStats[st.ID] = &st
 	}
+	s.logger.Info("loaded index snapshot",
+		"keys", snap.index.Len(), "segment", snap.segment, "offset", snap.offset)
+	return snap
+}
 
-	if err := s.activeFile.Sync(); err != nil {
-		return err
+// loadBloom replaces the empty bloom filter with the one saved alongside
+// the index snapshot just loaded, as long as it matches that snapshot and
+// the configured sizing. Otherwise the filter is rebuilt from the index.
+func (s *KVStore) loadBloom(o options) {
+	b, err := loadBloom(filepath.Join(s.baseDir, bloomFile), s.keys)
+	switch {
+	case err != nil:
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn("ignoring bloom filter", "err", err)
+		}
+	case b.Len() != uint(s.index.Len()):
+		s.logger.Warn("ignoring bloom filter", "reason", "key count does not match index snapshot")
+	case b.fpRate == o.bloomFPRate && b.Capacity() >= o.bloomExpectedKeys:
+		s.bloom = b
+		s.logger.Debug("loaded bloom filter", "keys", b.Len(), "capacity", b.Capacity())
+		return
 	}
 
-	// Update in-memory structures
-	valueCopy := make([]byte, len(value))
-	copy(valueCopy, value)
-	s.values[key] = valueCopy
-	s.index.Insert(key, s.activeSegmentID, 0)
-	s.bloom.Insert(key)
+	s.rebuildBloom(s.bloom.Capacity())
+}
 
-	// Check if segment is full
-	info, err := s.activeFile.Stat()
+// Set stores or updates a key-value pair
+func (s *KVStore) Set(key string, value []byte) error {
+	s.mu.Lock()
+	ticket, err := s.set(key, value, 0)
+	s.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	if uint64(info.Size()) >= s.maxSegmentSize {
+
+	return s.waitDurable(ticket)
+}
+
+// set appends a set record expiring at expiresAt (0 for never) and returns
+// its durability ticket; callers hold s.mu
+func (s *KVStore) set(key string, value []byte, expiresAt int64) (uint64, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	s.seq++
+	rec := compressRecord(&Record{
+		Op:        OpSet,
+		Seq:       s.seq,
+		Key:       key,
+		Value:     value,
+		ExpiresAt: expiresAt,
+	}, s.compression)
+
+	entry, err := s.appendRecord(rec)
+	if err != nil {
+		return 0, err
+	}
+	ticket := s.written
+
+	// Update in-memory structures
+	s.applySet(key, entry)
+
+	// Check if segment is full
+	if s.activeOffset >= s.maxSegmentSize {
 		if err := s.rotateSegment(); err != nil {
-			return err
+			return 0, err
 		}
 	}
 
-	return nil
+	return ticket, nil
 }
 
 // Get retrieves a value by key
@@ -142,47 +395,48 @@ func (s *KVStore) Get(key string) ([]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	// Fast in-memory lookup
-	if val, ok := s.values[key]; ok {
-		result := make([]byte, len(val))
-		copy(result, val)
-		return result, nil
-	}
-
-	// Bloom filter check
-	if !s.bloom.MightContain(key) {
+	entry, ok := s.lookup(key)
+	if !ok {
 		return nil, ErrNotFound
 	}
 
-	return nil, ErrNotFound
+	return s.readValue(key, entry)
 }
 
 // Delete removes a key
 func (s *KVStore) Delete(key string) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	rec := &Record{
-		Op:  OpDelete,
-		Key: key,
+	ticket, err := s.delete(key)
+	s.mu.Unlock()
+	if err != nil {
+		return err
 	}
 
-	if err := WriteRecord(s.activeWriter, rec); err != nil {
-		return err
+	return s.waitDurable(ticket)
+}
+
+// delete appends a tombstone and returns its durability ticket; callers
+// hold s.mu
+func (s *KVStore) delete(key string) (uint64, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
 	}
 
-	if err := s.activeWriter.Flush(); err != nil {
-		return err
+	s.seq++
+	rec := &Record{
+		Op:  OpDelete,
+		Seq: s.seq,
+		Key: key,
 	}
 
-	if err := s.activeFile.Sync(); err != nil {
-		return err
+	entry, err := s.appendRecord(rec)
+	if err != nil {
+		return 0, err
 	}
 
-	delete(s.values, key)
-	s.index.Remove(key)
+	s.applyDelete(key, entry)
 
-	return nil
+	return s.written, nil
 }
 
 // ListKeys returns all keys
@@ -190,57 +444,134 @@ func (s *KVStore) ListKeys() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	keys := make([]string, 0, len(s.values))
-	for k := range s.values {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
+	now := s.now()
+	var keys []string
+	s.index.Range(func(key string, entry *IndexEntry) bool {
+		if !expired(entry.ExpiresAt, now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
 	return keys
 }
 
+// lookup returns the index entry for a key unless the key is missing or
+// expired; callers hold s.mu
+func (s *KVStore) lookup(key string) (*IndexEntry, bool) {
+	// Bloom filter check
+	if !s.bloom.MightContain(key) {
+		return nil, false
+	}
+
+	entry, ok := s.index.Get(key)
+	if !ok || expired(entry.ExpiresAt, s.now()) {
+		return nil, false
+	}
+	return entry, true
+}
+
 // Stats returns storage statistics
 func (s *KVStore) Stats() StoreStats {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	segments, _ := findSegments(s.baseDir)
-	totalBytes := uint64(0)
-	for _, val := range s.values {
-		totalBytes += uint64(len(val))
-	}
+	totalBytes, storedBytes := uint64(0), uint64(0)
+	s.index.Range(func(_ string, entry *IndexEntry) bool {
+		totalBytes += uint64(entry.ValueSize)
+		storedBytes += uint64(entry.StoredSize)
+		return true
+	})
 
 	oldestID := 0
 	if len(segments) > 0 {
 		oldestID = int(segments[0])
 	}
 
+	segStats := make([]SegmentStats, 0, len(segments))
+	for _, segID := range segments {
+		segStats = append(segStats, s.segmentStats(segID))
+	}
+
 	return StoreStats{
-		NumKeys:         len(s.values),
+		NumKeys:         s.index.Len(),
 		NumSegments:     len(segments),
 		TotalBytes:      totalBytes,
+		StoredBytes:     storedBytes,
 		ActiveSegmentID: int(s.activeSegmentID),
 		OldestSegmentID: oldestID,
+		Segments:        segStats,
 	}
 }
 
 // SaveSnapshot saves the index to disk
 func (s *KVStore) SaveSnapshot() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	// The snapshot vouches for everything written so far, so that has to
+	// be on disk first
+	if err := s.activeFile.Sync(); err != nil {
+		return err
+	}
+
 	path := filepath.Join(s.baseDir, snapshotFile)
-	return SaveSnapshot(s.index, path)
+	if err := writeSnapshotFile(path, s.snapshot(), s.keys); err != nil {
+		return err
+	}
+	// The filter is only used together with the snapshot it was saved with
+	if err := saveBloom(s.bloom, filepath.Join(s.baseDir, bloomFile), s.keys); err != nil {
+		return fmt.Errorf("save bloom filter: %w", err)
+	}
+	s.logger.Info("saved index snapshot", "keys", s.index.Len(), "bloom_capacity", s.bloom.Capacity())
+	return nil
 }
 
 // Close closes the store
-func (s *KVStore) Close() error {
+func (s *KVStore) Close() (err error) {
+	// Let the next writer in once everything else is closed
+	defer func() {
+		if lockErr := s.lock.release(); err == nil {
+			err = lockErr
+		}
+		s.lock = nil
+	}()
+
+	// The background syncer takes s.mu, so stop it before locking
+	if s.stopSync != nil {
+		close(s.stopSync)
+		s.syncWG.Wait()
+		s.stopSync = nil
+	}
+
+	// Snapshots cannot outlive the store, so finish deleting what they pinned
+	s.releaseSnapshots()
+	if err := s.removeObsolete(); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	for w := range s.watchers {
+		s.closeWatcher(w)
+	}
+	s.closeReaders()
+
 	if s.activeWriter != nil {
 		if err := s.activeWriter.Flush(); err != nil {
 			return err
 		}
+		if err := s.activeFile.Sync(); err != nil {
+			return err
+		}
+		s.writeActiveHints()
+		// Every write is durable now
+		s.removeLarge(s.takeRetired(s.written))
 	}
 	if s.activeFile != nil {
 		return s.activeFile.Close()
@@ -248,48 +579,299 @@ func (s *KVStore) Close() error {
 	return nil
 }
 
-// replaySegment replays all records in a segment
-func (s *KVStore) replaySegment(path string, segID uint64) error {
+// applySet points key at a freshly written record and retires the record
+// it replaces
+func (s *KVStore) applySet(key string, entry *IndexEntry) {
+	s.preserve(key)
+	prev, existed := s.index.Get(key)
+	if existed {
+		s.markDead(prev)
+		s.retireLarge(prev)
+	}
+	s.index.Insert(key, entry)
+	if !existed {
+		s.bloomInsert(key)
+	}
+	s.segStat(entry.SegmentID).LiveBytes += uint64(entry.Size)
+	s.notify(OpSet, key, entry.Version)
+}
+
+// applyDelete removes key and counts the retired record as garbage. The
+// tombstone itself counts as live while an older segment may still hold a
+// value it shadows, since compaction has to keep it until then, and as
+// garbage otherwise.
+func (s *KVStore) applyDelete(key string, tombstone *IndexEntry) {
+	s.preserve(key)
+	if prev, ok := s.index.Get(key); ok {
+		s.markDead(prev)
+		s.retireLarge(prev)
+		s.bloom.Remove(key)
+	}
+	s.index.Remove(key)
+	if s.hasOlderSegment(tombstone.SegmentID) {
+		s.segStat(tombstone.SegmentID).LiveBytes += uint64(tombstone.Size)
+	} else {
+		s.segStat(tombstone.SegmentID).DeadBytes += uint64(tombstone.Size)
+	}
+	s.notify(OpDelete, key, tombstone.Version)
+}
+
+// hasOlderSegment reports whether any segment older than segID holds records
+func (s *KVStore) hasOlderSegment(segID uint64) bool {
+	for id := range s.segStats {
+		if id < segID {
+			return true
+		}
+	}
+	return false
+}
+
+// bloomInsert adds a key just added to the index to the bloom filter,
+// doubling the filter once it holds more keys than it was sized for
+func (s *KVStore) bloomInsert(key string) {
+	s.bloom.Insert(key)
+	if s.bloom.Len() > s.bloom.Capacity() {
+		s.rebuildBloom(2 * s.bloom.Capacity())
+	}
+}
+
+// rebuildBloom replaces the bloom filter with a fresh one sized for
+// capacity keys and filled from the index, which clears any counters that
+// saturated; callers hold s.mu for writing
+func (s *KVStore) rebuildBloom(capacity uint) {
+	if n := uint(s.index.Len()); capacity < n {
+		capacity = n
+	}
+	s.bloom = NewBloomIndexWithRate(capacity, s.bloom.fpRate)
+	s.index.Range(func(key string, _ *IndexEntry) bool {
+		s.bloom.Insert(key)
+		return true
+	})
+}
+
+// markDead moves a record's bytes from live to dead in its segment
+func (s *KVStore) markDead(entry *IndexEntry) {
+	st := s.segStat(entry.SegmentID)
+	size := uint64(entry.Size)
+	if st.LiveBytes < size {
+		size = st.LiveBytes
+	}
+	st.LiveBytes -= size
+	st.DeadBytes += uint64(entry.Size)
+}
+
+// segStat returns the mutable counters for a segment
+func (s *KVStore) segStat(segID uint64) *SegmentStats {
+	st, ok := s.segStats[segID]
+	if !ok {
+		st = &SegmentStats{ID: segID}
+		s.segStats[segID] = st
+	}
+	return st
+}
+
+// segmentStats returns a copy of the counters for a segment
+func (s *KVStore) segmentStats(segID uint64) SegmentStats {
+	if st, ok := s.segStats[segID]; ok {
+		return *st
+	}
+	return SegmentStats{ID: segID}
+}
+
+// appendRecord writes a record to the active segment and hands it to the
+// OS. Whether it is also fsynced is up to the sync policy; see
+// waitDurable. It returns the index entry describing where it landed.
+func (s *KVStore) appendRecord(rec *Record) (*IndexEntry, error) {
+	sealed, err := s.keys.sealRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteRecord(s.activeWriter, sealed); err != nil {
+		return nil, err
+	}
+
+	if err := s.activeWriter.Flush(); err != nil {
+		return nil, err
+	}
+	s.written++
+
+	entry := &IndexEntry{
+		SegmentID:  s.activeSegmentID,
+		Offset:     s.activeOffset,
+		Size:       recordSize(sealed),
+		ValueSize:  valueSize(rec),
+		StoredSize: storedValueSize(rec),
+		Version:    rec.Seq,
+		ExpiresAt:  rec.ExpiresAt,
+	}
+	s.activeOffset += uint64(entry.Size)
+	s.activeHints = append(s.activeHints, newHintEntry(rec.Op, rec.Key, entry))
+
+	return entry, nil
+}
+
+// writeActiveHints writes the hint file for the active segment as it is
+// sealed. Failing to write hints only costs a slower restart.
+func (s *KVStore) writeActiveHints() {
+	if s.activeOffset == 0 {
+		return
+	}
+	if err := writeHintFile(hintPath(s.baseDir, s.activeSegmentID), s.activeOffset, s.activeHints, s.keys); err != nil {
+		s.logger.Warn("failed to write hint file", "segment", s.activeSegmentID, "err", err)
+	}
+}
+
+// readRecordAt reads the record an index entry points to
+func (s *KVStore) readRecordAt(key string, entry *IndexEntry) (*Record, error) {
+	file, err := s.segmentReader(entry.SegmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, entry.Size)
+	if _, err := file.ReadAt(buf, int64(entry.Offset)); err != nil {
+		return nil, fmt.Errorf("read segment %d at %d: %w", entry.SegmentID, entry.Offset, err)
+	}
+
+	rec, err := ReadRecord(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("read segment %d at %d: %w", entry.SegmentID, entry.Offset, err)
+	}
+	if err := s.keys.openRecord(rec); err != nil {
+		return nil, fmt.Errorf("read segment %d at %d: %w", entry.SegmentID, entry.Offset, err)
+	}
+	if rec.Key != key {
+		return nil, fmt.Errorf("read segment %d at %d: %w", entry.SegmentID, entry.Offset, ErrCorrupted)
+	}
+	if err := decompressRecord(rec); err != nil {
+		return nil, fmt.Errorf("read segment %d at %d: %w", entry.SegmentID, entry.Offset, err)
+	}
+
+	return rec, nil
+}
+
+// segmentReader returns a cached read handle for a segment
+func (s *KVStore) segmentReader(segID uint64) (*os.File, error) {
+	s.readersMu.Lock()
+	defer s.readersMu.Unlock()
+
+	if file, ok := s.readers[segID]; ok {
+		return file, nil
+	}
+
+	file, err := os.Open(segmentPath(s.baseDir, segID))
+	if err != nil {
+		return nil, err
+	}
+	s.readers[segID] = file
+
+	return file, nil
+}
+
+// closeReader drops the cached read handle for a segment
+func (s *KVStore) closeReader(segID uint64) {
+	s.readersMu.Lock()
+	defer s.readersMu.Unlock()
+
+	if file, ok := s.readers[segID]; ok {
+		_ = file.Close()
+		delete(s.readers, segID)
+	}
+}
+
+// closeReaders drops every cached read handle
+func (s *KVStore) closeReaders() {
+	s.readersMu.Lock()
+	defer s.readersMu.Unlock()
+
+	for segID, file := range s.readers {
+		_ = file.Close()
+		delete(s.readers, segID)
+	}
+}
+
+// replaySegment replays the committed records in a segment from offset
+// from on. It returns hints for the records it applied, the offset just
+// past the last of them and the offset at which reading stopped.
+func (s *KVStore) replaySegment(path string, segID, from uint64) ([]hintEntry, uint64, uint64, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, 0, 0, err
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
+	if _, err := file.Seek(int64(from), io.SeekStart); err != nil {
+		return nil, from, from, err
+	}
+	r, err := newSizedReader(file, -1)
+	if err != nil {
+		return nil, from, from, err
+	}
 
-	for {
-		rec, err := ReadRecord(reader)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
+	var hints []hintEntry
+	valid, read, err := scanCommitted(r, func(rec *Record, offset uint64) error {
+		offset += from
+		size := storedSize(rec)
+		if err := s.keys.openRecord(rec); err != nil {
 			return err
 		}
 
+		entry := &IndexEntry{
+			SegmentID:  segID,
+			Offset:     offset,
+			Size:       size,
+			ValueSize:  valueSize(rec),
+			StoredSize: storedValueSize(rec),
+			ExpiresAt:  rec.ExpiresAt,
+		}
+
 		switch rec.Op {
 		case OpSet:
-			s.values[rec.Key] = rec.Value
-			s.index.Insert(rec.Key, segID, 0)
-			s.bloom.Insert(rec.Key)
+			entry.Version = s.replaySeq(rec.Seq)
+			s.applySet(rec.Key, entry)
 		case OpDelete:
-			delete(s.values, rec.Key)
-			s.index.Remove(rec.Key)
+			entry.Version = s.replaySeq(rec.Seq)
+			s.applyDelete(rec.Key, entry)
 		default:
-			return fmt.Errorf("unknown opcode: %d", rec.Op)
+			s.segStat(segID).DeadBytes += uint64(entry.Size)
+			entry.ValueSize = 0
+			entry.StoredSize = 0
 		}
-	}
 
-	return nil
+		hints = append(hints, newHintEntry(rec.Op, rec.Key, entry))
+		return nil
+	})
+
+	return hints, from + valid, from + read, err
+}
+
+// replaySeq returns the version of a replayed write and advances the
+// store's sequence past it. Records written before sequence numbers existed
+// carry none and are numbered in replay order instead.
+func (s *KVStore) replaySeq(seq uint64) uint64 {
+	if seq == 0 {
+		s.seq++
+		return s.seq
+	}
+	if seq > s.seq {
+		s.seq = seq
+	}
+	return seq
 }
 
 // resetActiveSegment creates a new active segment
 func (s *KVStore) resetActiveSegment(newID uint64) error {
-	// Close current segment
+	// Close current segment. Sealed segments are always fsynced, which
+	// group commit relies on.
 	if s.activeWriter != nil {
 		if err := s.activeWriter.Flush(); err != nil {
 			return err
 		}
+		if err := s.activeFile.Sync(); err != nil {
+			return err
+		}
+		s.commits.advance(s.written)
+		s.writeActiveHints()
 	}
 	if s.activeFile != nil {
 		if err := s.activeFile.Close(); err != nil {
@@ -304,16 +886,29 @@ func (s *KVStore) resetActiveSegment(newID uint64) error {
 		return err
 	}
 
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
 	s.activeSegmentID = newID
 	s.activeFile = file
 	s.activeWriter = bufio.NewWriter(file)
+	s.activeOffset = uint64(info.Size())
+	s.activeHints = nil
 
 	return nil
 }
 
 // rotateSegment creates a new active segment
 func (s *KVStore) rotateSegment() error {
-	return s.resetActiveSegment(s.activeSegmentID + 1)
+	sealedID, size := s.activeSegmentID, s.activeOffset
+	if err := s.resetActiveSegment(sealedID + 1); err != nil {
+		return err
+	}
+	s.logger.Debug("rotated segment", "sealed", sealedID, "bytes", size, "active", s.activeSegmentID)
+	return nil
 }
 
 // Helper functions
@@ -322,6 +917,10 @@ func segmentPath(dir string, id uint64) string {
 	return filepath.Join(dir, fmt.Sprintf("%s%d%s", segmentPrefix, id, segmentSuffix))
 }
 
+func hintPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d%s", segmentPrefix, id, hintSuffix))
+}
+
 func findSegments(dir string) ([]uint64, error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -1,8 +1,14 @@
 package store
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -218,3 +224,246 @@ func TestSnapshot(t *testing.T) {
 		require.NoError(t, store.Close())
 	}
 }
+
+func TestGetReadsFromSegments(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	// Force frequent rotation so values span several segments
+	store.maxSegmentSize = 256
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		require.NoError(t, store.Set(key, []byte(fmt.Sprintf("value%02d", i))))
+	}
+	assert.Greater(t, store.Stats().NumSegments, 1)
+
+	entry, ok := store.index.Get("key10")
+	require.True(t, ok)
+	assert.Equal(t, uint32(7), entry.ValueSize)
+
+	for i := 0; i < 50; i++ {
+		val, err := store.Get(fmt.Sprintf("key%02d", i))
+		require.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value%02d", i)), val)
+	}
+
+	// Offsets survive a restart
+	require.NoError(t, store.Close())
+	store, err := Open(dir)
+	require.NoError(t, err)
+
+	reopened, ok := store.index.Get("key10")
+	require.True(t, ok)
+	assert.Equal(t, entry.SegmentID, reopened.SegmentID)
+	assert.Equal(t, entry.Offset, reopened.Offset)
+
+	val, err := store.Get("key49")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value49"), val)
+}
+
+func TestTornTailRecovery(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.Set("key1", []byte("value1")))
+	require.NoError(t, store.Set("key2", []byte("value2")))
+	segID := store.activeSegmentID
+	require.NoError(t, store.Close())
+
+	// Simulate a crash halfway through writing a third record
+	var buf bytes.Buffer
+	require.NoError(t, WriteRecord(&buf, &Record{Op: OpSet, Key: "key3", Value: []byte("value3")}))
+	path := segmentPath(dir, segID)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(buf.Bytes()[:buf.Len()/2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	store, err = Open(dir)
+	require.NoError(t, err)
+
+	val, err := store.Get("key2")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value2"), val)
+
+	_, err = store.Get("key3")
+	assert.Equal(t, ErrNotFound, err)
+
+	info2, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), info2.Size())
+}
+
+func TestTornHeaderWithHugeLength(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.Set("key1", []byte("value1")))
+	segID := store.activeSegmentID
+	require.NoError(t, store.Close())
+
+	// A header whose value length points far past the end of the file
+	var buf bytes.Buffer
+	require.NoError(t, WriteRecord(&buf, &Record{Op: OpSet, Key: "key2", Value: []byte("value2")}))
+	header := buf.Bytes()[:recordHeaderSize]
+	binary.LittleEndian.PutUint32(header[16:20], maxValueSize)
+	path := segmentPath(dir, segID)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(header)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	store, err = Open(dir)
+	require.NoError(t, err)
+
+	val, err := store.Get("key1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value1"), val)
+
+	info2, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), info2.Size())
+}
+
+func TestReadRecordRefusesHugeLengths(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteRecord(&buf, &Record{Op: OpSet, Key: "key", Value: []byte("value")}))
+	data := buf.Bytes()
+
+	// Beyond the limit, whatever the reader holds
+	binary.LittleEndian.PutUint32(data[16:20], math.MaxUint32)
+	_, err := ReadRecord(io.MultiReader(bytes.NewReader(data), zeroReader{}))
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	// Within the limit but past the end of the data
+	binary.LittleEndian.PutUint32(data[16:20], maxValueSize)
+	_, err = ReadRecord(bytes.NewReader(data))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	assert.ErrorIs(t, WriteRecord(io.Discard, &Record{Op: OpSet, Key: strings.Repeat("k", maxKeySize+1)}), ErrKeyTooLarge)
+}
+
+// zeroReader never runs out of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestCorruptionInOlderSegment(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, store.Set("key1", []byte("value1")))
+	require.NoError(t, store.Set("key2", []byte("value2")))
+	segID := store.activeSegmentID
+	require.NoError(t, store.Close())
+
+	// Reopen once so the damaged segment is no longer the newest
+	store, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	path := segmentPath(dir, segID)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xFF
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	require.NoError(t, os.Remove(hintPath(dir, segID)))
+
+	_, err = Open(dir)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestHintFiles(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	store.maxSegmentSize = 256
+	for i := 0; i < 40; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%02d", i), []byte("value")))
+	}
+	require.NoError(t, store.Delete("key05"))
+	require.NoError(t, store.Close())
+
+	// Every sealed segment gets a hint file that matches its records
+	segments, err := findSegments(dir)
+	require.NoError(t, err)
+	require.Greater(t, len(segments), 1)
+	for _, segID := range segments {
+		hints, err := loadSegmentHints(dir, segID, nil)
+		require.NoError(t, err, "segment %d", segID)
+
+		var offsets []uint64
+		require.NoError(t, (&KVStore{baseDir: dir}).scanSegment(segID, func(rec *Record, offset uint64) error {
+			offsets = append(offsets, offset)
+			return nil
+		}))
+		require.Len(t, hints, len(offsets))
+		for i, hint := range hints {
+			assert.Equal(t, offsets[i], hint.Offset)
+		}
+	}
+
+	// A damaged hint falls back to replaying the segment
+	hintFile := hintPath(dir, segments[0])
+	data, err := os.ReadFile(hintFile)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xFF
+	require.NoError(t, os.WriteFile(hintFile, data, 0644))
+
+	store, err = Open(dir)
+	require.NoError(t, err)
+	assert.Len(t, store.ListKeys(), 39)
+	_, err = store.Get("key05")
+	assert.Equal(t, ErrNotFound, err)
+	val, err := store.Get("key00")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestFailedOpenReleasesFiles(t *testing.T) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files cannot be counted here")
+	}
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	defer os.RemoveAll(dir)
+
+	store, err := OpenWithOptions(dir, WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	require.NoError(t, store.PutReader("big", bytes.NewReader(largeValue(5000)), -1))
+	entry, ok := store.index.Get("big")
+	require.True(t, ok)
+	require.NoError(t, store.Close())
+
+	// Two generations of the file make Open read the damaged record that
+	// refers to them, after replay has opened the segment
+	require.NoError(t, os.WriteFile(largePath(dir, entry.Version, 1), nil, 0644))
+	path := segmentPath(dir, entry.SegmentID)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	fds, err = os.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = Open(dir)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrLocked)
+	}
+	after, err := os.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	assert.Len(t, after, len(fds))
+}
@@ -23,6 +23,34 @@ var (
 
 	// ErrNoActiveSegment indicates no active segment is available
 	ErrNoActiveSegment = errors.New("no active segment")
+
+	// ErrVersionMismatch indicates a conditional write found the key at a
+	// different version than expected
+	ErrVersionMismatch = errors.New("version mismatch")
+
+	// ErrInvalidTTL indicates a time-to-live that is not positive
+	ErrInvalidTTL = errors.New("ttl must be positive")
+
+	// ErrMissingKey indicates data encrypted with a key the store was not
+	// given
+	ErrMissingKey = errors.New("missing encryption key")
+
+	// ErrReadOnly indicates a write to a store opened read-only
+	ErrReadOnly = errors.New("store is read-only")
+
+	// ErrLocked indicates the store directory is already open for writing
+	// by another store
+	ErrLocked = errors.New("store directory is locked")
+
+	// ErrSnapshotReleased indicates a read through a released Snapshot
+	ErrSnapshotReleased = errors.New("snapshot released")
+
+	// ErrKeyTooLarge indicates a key longer than a record can hold
+	ErrKeyTooLarge = errors.New("key too large")
+
+	// ErrValueTooLarge indicates a value longer than a record can hold;
+	// PutReader stores longer values as large objects
+	ErrValueTooLarge = errors.New("value too large")
 )
 
 // StoreError wraps errors with context
@@ -0,0 +1,502 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Problem is one piece of damage Check found in a store
+type Problem struct {
+	File    string // File the damage is in, relative to the store directory
+	Offset  uint64 // Where in a segment the damage starts
+	Skipped uint64 // Bytes of the segment passed over to get past it
+	Err     error  // What is wrong, e.g. ErrChecksumMismatch
+}
+
+func (p Problem) String() string {
+	if p.File == snapshotFile {
+		return fmt.Sprintf("%s: %v", p.File, p.Err)
+	}
+	s := fmt.Sprintf("%s at offset %d: %v", p.File, p.Offset, p.Err)
+	if p.Skipped > 0 {
+		s += fmt.Sprintf(" (%d bytes skipped)", p.Skipped)
+	}
+	return s
+}
+
+// CheckReport is the outcome of Check or Repair
+type CheckReport struct {
+	Segments int       // Segments read
+	Large    int       // Large object files read
+	Records  int       // Intact records kept, batch markers included
+	Problems []Problem // Damage found, in file order
+	Notes    []string  // What could not be checked, and why
+}
+
+// OK reports whether no damage was found
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Check reads every record of the store in dir and reports what Open would
+// stop at or drop: bad magic bytes, checksum mismatches, unknown opcodes,
+// truncated tails and unfinished batches. Large object files are read
+// chunk by chunk, and every key whose value is a large object must have
+// its file intact. Check then replays the segments up to the position of
+// the index snapshot and compares the result with it. opts supply the
+// keyring of an encrypted store, without which the snapshot cannot be
+// checked. Check never modifies dir, but a store that is being written to
+// may show a truncated tail.
+func Check(dir string, opts ...Option) (*CheckReport, error) {
+	c := newChecker(dir, opts)
+	if err := c.run(); err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+// Repair checks the store in dir like Check and, if anything is damaged,
+// rewrites it with only the intact records, dropping batches that lost
+// any of theirs, and the intact large objects. Keys whose large object is
+// lost are deleted. The original directory is kept as dir + ".damaged". The
+// index snapshot, bloom filter and hint files are left behind for Open to
+// rebuild. Repair fails with ErrLocked while another process has the store
+// open, and keeps others out until the repaired store is in place.
+func Repair(dir string, opts ...Option) (*CheckReport, error) {
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	dir = filepath.Clean(dir)
+	damaged := dir + ".damaged"
+	if _, err := os.Stat(damaged); err == nil {
+		return nil, fmt.Errorf("repair: %s already exists", damaged)
+	}
+
+	c := newChecker(dir, opts)
+	c.out = dir + ".repair"
+	if err := os.RemoveAll(c.out); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(c.out, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(c.out)
+
+	if err := c.run(); err != nil {
+		return nil, err
+	}
+	if c.report.OK() {
+		return c.report, nil
+	}
+	if err := syncDir(c.out); err != nil {
+		return nil, err
+	}
+
+	// The lock on the original moves away with it, so the repaired
+	// directory is locked before it takes the original's place
+	outLock, err := lockDir(c.out)
+	if err != nil {
+		return nil, err
+	}
+	defer outLock.release()
+
+	if err := os.Rename(dir, damaged); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(c.out, dir); err != nil {
+		if undoErr := os.Rename(damaged, dir); undoErr != nil {
+			return nil, fmt.Errorf("%w (restoring %s: %v)", err, dir, undoErr)
+		}
+		return nil, err
+	}
+	if afterRepairSwap != nil {
+		afterRepairSwap()
+	}
+	if err := syncDir(filepath.Dir(dir)); err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+// afterRepairSwap, if set, runs once Repair has put the repaired directory
+// in place; tests use it to reach the store in the middle of a repair
+var afterRepairSwap func()
+
+// checker walks the segments of a store, collecting problems and, when
+// repairing, writing the intact records to out
+type checker struct {
+	dir    string
+	out    string // Directory to write repaired segments to, "" to only check
+	keys   *Keyring
+	report *CheckReport
+
+	// Index snapshot being checked and the index replayed from the
+	// segments it covers; nil if there is nothing to check it against
+	snap     *indexSnapshot
+	replayed map[string]*IndexEntry
+	seq      uint64
+
+	missingKey bool // Some record could not be decrypted for want of a key
+
+	// Intact large object files, and the latest write of every key that
+	// refers to one
+	large     map[largeFile]bool
+	largeRefs map[string]largeRef
+	maxSeq    uint64 // Highest sequence number among the intact records
+}
+
+// largeRef is a set record that refers to a large object
+type largeRef struct {
+	file   string
+	offset uint64
+	large  largeFile
+	bad    bool // The record does not describe a large object
+}
+
+// checkedRecord is an intact record and where it starts in its segment
+type checkedRecord struct {
+	rec    *Record
+	offset uint64
+}
+
+func newChecker(dir string, opts []Option) *checker {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &checker{
+		dir:       dir,
+		keys:      o.keyring,
+		report:    &CheckReport{},
+		large:     make(map[largeFile]bool),
+		largeRefs: make(map[string]largeRef),
+	}
+}
+
+func (c *checker) run() error {
+	segments, err := findSegments(c.dir)
+	if err != nil {
+		return err
+	}
+
+	files, err := findLarge(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := c.checkLarge(f); err != nil {
+			return fmt.Errorf("check large object %d: %w", f.version, err)
+		}
+	}
+
+	c.loadSnapshot(segments)
+	for _, segID := range segments {
+		if err := c.checkSegment(segID); err != nil {
+			return fmt.Errorf("check segment %d: %w", segID, err)
+		}
+	}
+	c.compareSnapshot()
+
+	var next uint64 = 1
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	return c.checkLargeRefs(next)
+}
+
+func (c *checker) problem(file string, offset, skipped uint64, err error) {
+	c.report.Problems = append(c.report.Problems, Problem{File: file, Offset: offset, Skipped: skipped, Err: err})
+}
+
+func (c *checker) note(format string, args ...any) {
+	c.report.Notes = append(c.report.Notes, fmt.Sprintf(format, args...))
+}
+
+// loadSnapshot reads the index snapshot to compare with the segments, as
+// long as it is one Open would use
+func (c *checker) loadSnapshot(segments []uint64) {
+	snap, err := readSnapshotFile(filepath.Join(c.dir, snapshotFile), c.keys)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.note("no index snapshot to check")
+	case errors.Is(err, ErrMissingKey):
+		c.note("index snapshot not checked: %v", err)
+	case err != nil:
+		c.problem(snapshotFile, 0, 0, err)
+	case !snap.covers(c.dir, segments):
+		c.note("index snapshot is out of date; Open rebuilds the index from the segments")
+	default:
+		c.snap = snap
+		c.replayed = make(map[string]*IndexEntry)
+	}
+}
+
+// checkSegment reads a segment record by record. Past damage it skips ahead
+// to the next intact record, so one bad record costs no more than itself
+// and the batch it belongs to.
+func (c *checker) checkSegment(segID uint64) error {
+	path := segmentPath(c.dir, segID)
+	name := filepath.Base(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.report.Segments++
+
+	var intact, batch []checkedRecord
+	dropBatch := func() {
+		if batch == nil {
+			return
+		}
+		last := batch[len(batch)-1]
+		end := last.offset + uint64(storedSize(last.rec))
+		c.problem(name, batch[0].offset, end-batch[0].offset, errIncompleteBatch)
+		batch = nil
+	}
+
+	err = walkSegment(data, func(offset, size uint64, rec *Record, err error) error {
+		if err == nil && (rec.Op == OpSet || rec.Op == OpDelete) {
+			err = c.openRecord(rec)
+		}
+		if err != nil {
+			dropBatch()
+			c.problem(name, offset, size, err)
+			return nil
+		}
+
+		switch rec.Op {
+		case OpSet, OpDelete:
+			if batch != nil {
+				batch = append(batch, checkedRecord{rec, offset})
+			} else {
+				intact = append(intact, checkedRecord{rec, offset})
+			}
+		case OpBatchBegin:
+			dropBatch()
+			batch = []checkedRecord{{rec, offset}}
+		case OpBatchCommit:
+			if batch == nil || !matchesBatch(batch[0].rec, rec, len(batch)-1) {
+				dropBatch()
+				c.problem(name, offset, size, fmt.Errorf("unmatched batch commit: %w", ErrCorrupted))
+				break
+			}
+			intact = append(append(intact, batch...), checkedRecord{rec, offset})
+			batch = nil
+		default:
+			dropBatch()
+			c.problem(name, offset, size, fmt.Errorf("%w: %d", ErrInvalidOpcode, rec.Op))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dropBatch()
+
+	c.report.Records += len(intact)
+	for _, r := range intact {
+		c.replay(segID, r)
+		c.trackLarge(name, r)
+	}
+	if c.out == "" || len(intact) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, r := range intact {
+		buf.Write(data[r.offset : r.offset+uint64(storedSize(r.rec))])
+	}
+	return writeSyncedFile(segmentPath(c.out, segID), &buf)
+}
+
+// openRecord decrypts rec so its key can be compared with the snapshot.
+// Without the key that is skipped, but a record that fails to decrypt with
+// it is damaged.
+func (c *checker) openRecord(rec *Record) error {
+	err := c.keys.openRecord(rec)
+	if !errors.Is(err, ErrMissingKey) {
+		return err
+	}
+	if !c.missingKey {
+		c.missingKey = true
+		c.note("records not decrypted: %v", err)
+	}
+	return nil
+}
+
+// replay applies an intact record to the index rebuilt from the segments,
+// the same way Open does, if the snapshot covers it
+func (c *checker) replay(segID uint64, r checkedRecord) {
+	if c.snap == nil || r.rec.Op != OpSet && r.rec.Op != OpDelete {
+		return
+	}
+	if segID > c.snap.segment || segID == c.snap.segment && r.offset >= c.snap.offset {
+		return
+	}
+
+	version := r.rec.Seq
+	if version == 0 {
+		c.seq++
+		version = c.seq
+	} else if version > c.seq {
+		c.seq = version
+	}
+
+	if r.rec.Op == OpDelete {
+		delete(c.replayed, r.rec.Key)
+		return
+	}
+	c.replayed[r.rec.Key] = &IndexEntry{
+		SegmentID: segID,
+		Offset:    r.offset,
+		Size:      storedSize(r.rec),
+		Version:   version,
+	}
+}
+
+// compareSnapshot reports every key the snapshot and the replayed segments
+// disagree about
+func (c *checker) compareSnapshot() {
+	if c.snap == nil {
+		return
+	}
+	if c.missingKey {
+		c.note("index snapshot not checked: records could not be decrypted")
+		return
+	}
+
+	c.snap.index.Range(func(key string, entry *IndexEntry) bool {
+		got, ok := c.replayed[key]
+		switch {
+		case !ok:
+			c.problem(snapshotFile, 0, 0, fmt.Errorf("%w: key %q is not in the segments", ErrCorrupted, key))
+		case got.SegmentID != entry.SegmentID || got.Offset != entry.Offset || got.Size != entry.Size:
+			c.problem(snapshotFile, 0, 0, fmt.Errorf(
+				"%w: key %q is at segment %d offset %d, the segments have it at segment %d offset %d",
+				ErrCorrupted, key, entry.SegmentID, entry.Offset, got.SegmentID, got.Offset))
+		case got.Version != entry.Version:
+			c.problem(snapshotFile, 0, 0, fmt.Errorf("%w: key %q has version %d, the segments have %d",
+				ErrCorrupted, key, entry.Version, got.Version))
+		}
+		delete(c.replayed, key)
+		return true
+	})
+
+	missing := make([]string, 0, len(c.replayed))
+	for key := range c.replayed {
+		missing = append(missing, key)
+	}
+	sort.Strings(missing)
+	for _, key := range missing {
+		c.problem(snapshotFile, 0, 0, fmt.Errorf("%w: key %q is missing", ErrCorrupted, key))
+	}
+}
+
+// checkLarge reads a large object file chunk by chunk and, when repairing,
+// links it into out if it is intact
+func (c *checker) checkLarge(f largeFile) error {
+	path := largePath(c.dir, f.version, f.gen)
+	name := filepath.Base(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.report.Large++
+
+	intact := true
+	next := uint64(0)
+	err = walkSegment(data, func(offset, size uint64, rec *Record, err error) error {
+		if err == nil && (rec.Op != OpChunk || rec.Seq != next) {
+			err = fmt.Errorf("%w: chunk %d is op %d seq %d", ErrCorrupted, next, rec.Op, rec.Seq)
+		}
+		if err == nil {
+			err = c.openRecord(rec)
+		}
+		if err != nil {
+			intact = false
+			c.problem(name, offset, size, err)
+		}
+		next++
+		return nil
+	})
+	if err != nil || !intact {
+		return err
+	}
+
+	c.large[f] = true
+	if c.out == "" {
+		return nil
+	}
+	// Large objects are never modified, so the repaired store can share them
+	return os.Link(path, largePath(c.out, f.version, f.gen))
+}
+
+// trackLarge remembers which large object, if any, the latest write of a
+// key refers to. Keys of records that could not be decrypted are not
+// known, so those are left out.
+func (c *checker) trackLarge(name string, r checkedRecord) {
+	rec := r.rec
+	if rec.Seq > c.maxSeq {
+		c.maxSeq = rec.Seq
+	}
+	if rec.KeyID != 0 || rec.Op != OpSet && rec.Op != OpDelete {
+		return
+	}
+	if rec.Op == OpSet && rec.Large {
+		obj, err := decodeLargeObject(rec.Value)
+		c.largeRefs[rec.Key] = largeRef{
+			file:   name,
+			offset: r.offset,
+			large:  largeFile{rec.Seq, obj.gen},
+			bad:    err != nil,
+		}
+		return
+	}
+	delete(c.largeRefs, rec.Key)
+}
+
+// checkLargeRefs reports every key whose large object is missing or
+// damaged and, when repairing, deletes them in a new segment nextID so
+// they read as missing rather than failing
+func (c *checker) checkLargeRefs(nextID uint64) error {
+	if c.missingKey {
+		c.note("large object references not checked: records could not be decrypted")
+		return nil
+	}
+
+	var lost []string
+	for key, ref := range c.largeRefs {
+		if ref.bad || !c.large[ref.large] {
+			lost = append(lost, key)
+		}
+	}
+	sort.Strings(lost)
+	for _, key := range lost {
+		ref := c.largeRefs[key]
+		c.problem(ref.file, ref.offset, 0, fmt.Errorf("%w: key %q refers to large object %d, which is missing or damaged",
+			ErrCorrupted, key, ref.large.version))
+	}
+	if c.out == "" || len(lost) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, key := range lost {
+		c.maxSeq++
+		sealed, err := c.keys.sealRecord(&Record{Op: OpDelete, Seq: c.maxSeq, Key: key})
+		if err != nil {
+			return err
+		}
+		if err := WriteRecord(&buf, sealed); err != nil {
+			return err
+		}
+	}
+	return writeSyncedFile(segmentPath(c.out, nextID), &buf)
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAndRepair(t *testing.T) {
+	store, dir := setupTestStore(t)
+	damaged := dir + ".damaged"
+	require.NoError(t, os.RemoveAll(damaged))
+	defer os.RemoveAll(damaged)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+	b := NewBatch()
+	b.Set("batch1", []byte("a"))
+	b.Set("batch2", []byte("b"))
+	require.NoError(t, store.Write(b))
+	require.NoError(t, store.SaveSnapshot())
+	require.NoError(t, store.Set("after-snapshot", []byte("v")))
+
+	flipped, ok := store.index.Get("key3")
+	require.True(t, ok)
+	batch1, ok := store.index.Get("batch1")
+	require.True(t, ok)
+	inBatch, ok := store.index.Get("batch2")
+	require.True(t, ok)
+	want := contents(t, store)
+	delete(want, "key3")
+	delete(want, "batch1")
+	delete(want, "batch2")
+	require.NoError(t, store.Close())
+
+	report, err := Check(dir)
+	require.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, 1, report.Segments)
+	assert.Equal(t, 15, report.Records)
+
+	// Damage one record on its own and one inside the batch, write an
+	// unknown opcode and leave a torn write at the end
+	path := segmentPath(dir, 1)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[flipped.Offset+uint64(flipped.Size)-6] ^= 0xff
+	data[inBatch.Offset] = 0
+	unknown := uint64(len(data))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = file.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, WriteRecord(file, &Record{Op: 9, Seq: 99, Key: "odd"}))
+	_, err = file.Write([]byte{0xF0, 0xF2, OpSet})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	report, err = Check(dir)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 9, report.Problems)
+	segment := []Problem{
+		{File: "segment-1.dat", Offset: flipped.Offset, Skipped: uint64(flipped.Size), Err: ErrChecksumMismatch},
+		{File: "segment-1.dat", Offset: batch1.Offset - 28, Skipped: 28 + uint64(batch1.Size), Err: errIncompleteBatch},
+		{File: "segment-1.dat", Offset: inBatch.Offset, Skipped: uint64(inBatch.Size), Err: ErrInvalidMagic},
+		{File: "segment-1.dat", Offset: inBatch.Offset + uint64(inBatch.Size), Skipped: 28, Err: ErrCorrupted},
+		{File: "segment-1.dat", Offset: unknown, Skipped: 27, Err: ErrInvalidOpcode},
+		{File: "segment-1.dat", Offset: unknown + 27, Skipped: 3, Err: io.ErrUnexpectedEOF},
+	}
+	for i, p := range segment {
+		got := report.Problems[i]
+		assert.Equal(t, p.File, got.File, got.String())
+		assert.Equal(t, p.Offset, got.Offset, got.String())
+		assert.Equal(t, p.Skipped, got.Skipped, got.String())
+		assert.True(t, errors.Is(got.Err, p.Err), got.String())
+	}
+	// The snapshot still has the keys whose records were lost
+	for i, key := range []string{"batch1", "batch2", "key3"} {
+		got := report.Problems[len(segment)+i]
+		assert.Equal(t, snapshotFile, got.File)
+		assert.Contains(t, got.Err.Error(), fmt.Sprintf("%q is not in the segments", key))
+	}
+
+	report, err = Repair(dir)
+	require.NoError(t, err)
+	assert.Len(t, report.Problems, 9)
+	_, err = os.Stat(segmentPath(damaged, 1))
+	require.NoError(t, err)
+
+	report, err = Check(dir)
+	require.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, 10, report.Records)
+
+	store, err = Open(dir)
+	require.NoError(t, err)
+	defer cleanupTestStore(t, store, dir)
+	assert.Equal(t, want, contents(t, store))
+
+	// A store in use cannot be repaired
+	_, err = Repair(dir)
+	assert.ErrorIs(t, err, ErrLocked)
+}
+
+func TestRepairKeepsStoreLocked(t *testing.T) {
+	store, dir := setupTestStore(t)
+	damaged := dir + ".damaged"
+	require.NoError(t, os.RemoveAll(damaged))
+	defer os.RemoveAll(damaged)
+
+	require.NoError(t, store.Set("key", []byte("value")))
+	require.NoError(t, store.Close())
+	file, err := os.OpenFile(segmentPath(dir, 1), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	require.NoError(t, WriteRecord(file, &Record{Op: 9, Seq: 99, Key: "odd"}))
+	require.NoError(t, file.Close())
+
+	var openErr error
+	afterRepairSwap = func() {
+		var s *KVStore
+		if s, openErr = Open(dir); openErr == nil {
+			s.Close()
+		}
+	}
+	defer func() { afterRepairSwap = nil }()
+
+	report, err := Repair(dir)
+	require.NoError(t, err)
+	assert.Len(t, report.Problems, 1)
+	assert.ErrorIs(t, openErr, ErrLocked)
+
+	store, err = Open(dir)
+	require.NoError(t, err)
+	defer cleanupTestStore(t, store, dir)
+	val, err := store.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const hintSuffix = ".hint"
+
+var hintMagic = [8]byte{'K', 'V', 'H', 'I', 'N', 'T', '0', '4'}
+
+// hintEntry is the keydir-relevant part of one record in a segment
+type hintEntry struct {
+	Op         byte
+	Key        string
+	Offset     uint64
+	Size       uint32
+	ValueSize  uint32
+	StoredSize uint32
+	Seq        uint64
+	ExpiresAt  int64
+}
+
+// newHintEntry describes a record written at entry
+func newHintEntry(op byte, key string, entry *IndexEntry) hintEntry {
+	return hintEntry{
+		Op:         op,
+		Key:        key,
+		Offset:     entry.Offset,
+		Size:       entry.Size,
+		ValueSize:  entry.ValueSize,
+		StoredSize: entry.StoredSize,
+		Seq:        entry.Version,
+		ExpiresAt:  entry.ExpiresAt,
+	}
+}
+
+// indexEntry converts a hint back into the index entry it describes
+func (h *hintEntry) indexEntry(segID uint64) *IndexEntry {
+	return &IndexEntry{
+		SegmentID:  segID,
+		Offset:     h.Offset,
+		Size:       h.Size,
+		ValueSize:  h.ValueSize,
+		StoredSize: h.StoredSize,
+		Version:    h.Seq,
+		ExpiresAt:  h.ExpiresAt,
+	}
+}
+
+// writeHintFile writes the hints for a sealed segment of segSize bytes.
+// Hints are only an optimisation, so the file is not fsynced: a hint lost
+// or torn by a crash fails its checksum and the segment is replayed instead.
+func writeHintFile(path string, segSize uint64, hints []hintEntry, keys *Keyring) error {
+	var buf bytes.Buffer
+	if err := encodeHints(&buf, segSize, hints); err != nil {
+		return err
+	}
+	data := binary.LittleEndian.AppendUint32(buf.Bytes(), crc32.ChecksumIEEE(buf.Bytes()))
+
+	// Hints hold every key of the segment, so they are encrypted too
+	data, err := keys.sealFile(data)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func encodeHints(w io.Writer, segSize uint64, hints []hintEntry) error {
+	if _, err := w.Write(hintMagic[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, segSize); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(hints))); err != nil {
+		return err
+	}
+
+	for i := range hints {
+		hint := &hints[i]
+		if _, err := w.Write([]byte{hint.Op}); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(hint.Key))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, hint.Key); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, hint.Offset); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, hint.Size); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, hint.ValueSize); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, hint.StoredSize); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, hint.Seq); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, hint.ExpiresAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readHintFile loads the hints for a segment, rejecting the file if it is
+// damaged or was written for a segment of a different size
+func readHintFile(path string, segSize uint64, keys *Keyring) ([]hintEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = keys.openFile(data); err != nil {
+		return nil, err
+	}
+	if len(data) < len(hintMagic)+8+8+4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	body, trailer := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(trailer) {
+		return nil, ErrChecksumMismatch
+	}
+
+	r := bytes.NewReader(body)
+
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != hintMagic {
+		return nil, ErrInvalidMagic
+	}
+
+	var size, count uint64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size != segSize {
+		return nil, fmt.Errorf("hint covers %d bytes, segment has %d", size, segSize)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, ErrCorrupted
+	}
+
+	hints := make([]hintEntry, count)
+	for i := range hints {
+		hint := &hints[i]
+
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		hint.Op = op
+
+		var keyLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &keyLen); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if uint64(keyLen) > uint64(r.Len()) {
+			return nil, ErrCorrupted
+		}
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		hint.Key = string(key)
+
+		if err := binary.Read(r, binary.LittleEndian, &hint.Offset); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hint.Size); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hint.ValueSize); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hint.StoredSize); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hint.Seq); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hint.ExpiresAt); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	if r.Len() != 0 {
+		return nil, ErrCorrupted
+	}
+
+	return hints, nil
+}
+
+// replayHints applies a segment's hints to the in-memory structures
+func (s *KVStore) replayHints(segID uint64, hints []hintEntry) error {
+	for i := range hints {
+		hint := &hints[i]
+		switch hint.Op {
+		case OpSet:
+			hint.Seq = s.replaySeq(hint.Seq)
+			s.applySet(hint.Key, hint.indexEntry(segID))
+		case OpDelete:
+			hint.Seq = s.replaySeq(hint.Seq)
+			s.applyDelete(hint.Key, hint.indexEntry(segID))
+		case OpBatchBegin, OpBatchCommit:
+			s.segStat(segID).DeadBytes += uint64(hint.Size)
+		default:
+			return fmt.Errorf("hint %d: %w: %d", i, ErrInvalidOpcode, hint.Op)
+		}
+	}
+	return nil
+}
+
+// hintsFrom returns the hints for records at or after offset from
+func hintsFrom(hints []hintEntry, from uint64) []hintEntry {
+	for i := range hints {
+		if hints[i].Offset >= from {
+			return hints[i:]
+		}
+	}
+	return nil
+}
+
+// loadSegmentHints returns the hints for a segment. The error wraps
+// os.ErrNotExist if the segment has no hint file.
+func loadSegmentHints(dir string, segID uint64, keys *Keyring) ([]hintEntry, error) {
+	info, err := os.Stat(segmentPath(dir, segID))
+	if err != nil {
+		return nil, err
+	}
+
+	return readHintFile(hintPath(dir, segID), uint64(info.Size()), keys)
+}
@@ -4,32 +4,34 @@ import "sync"
 
 // IndexEntry represents a location in a segment
 type IndexEntry struct {
-	SegmentID uint64
-	Offset    uint64
+	SegmentID  uint64
+	Offset     uint64
+	Size       uint32 // Encoded record size on disk
+	ValueSize  uint32 // Length of the value
+	StoredSize uint32 // Length of the value on disk, after compression
+	Version    uint64 // Sequence number of the write that stored the value
+	ExpiresAt  int64  // Unix nanoseconds after which the value is gone, 0 for never
 }
 
-// Index provides fast in-memory key lookups
+// Index provides fast in-memory key lookups and keeps keys in sorted order
 type Index struct {
 	mu   sync.RWMutex
-	data map[string]*IndexEntry
+	list *skipList
 }
 
 // NewIndex creates a new empty index
 func NewIndex() *Index {
 	return &Index{
-		data: make(map[string]*IndexEntry),
+		list: newSkipList(),
 	}
 }
 
 // Insert adds or updates a key location
-func (idx *Index) Insert(key string, segmentID, offset uint64) {
+func (idx *Index) Insert(key string, entry *IndexEntry) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	idx.data[key] = &IndexEntry{
-		SegmentID: segmentID,
-		Offset:    offset,
-	}
+	idx.list.set(key, entry)
 }
 
 // Get retrieves the location for a key
@@ -37,8 +39,7 @@ func (idx *Index) Get(key string) (*IndexEntry, bool) {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	entry, ok := idx.data[key]
-	return entry, ok
+	return idx.list.get(key)
 }
 
 // Remove deletes a key from the index
@@ -46,7 +47,7 @@ func (idx *Index) Remove(key string) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	delete(idx.data, key)
+	idx.list.remove(key)
 }
 
 // Contains checks if a key exists
@@ -54,7 +55,7 @@ func (idx *Index) Contains(key string) bool {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	_, ok := idx.data[key]
+	_, ok := idx.list.get(key)
 	return ok
 }
 
@@ -63,27 +64,47 @@ func (idx *Index) Len() int {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	return len(idx.data)
+	return idx.list.len
 }
 
-// Keys returns all keys (snapshot)
+// Keys returns all keys in ascending order (snapshot)
 func (idx *Index) Keys() []string {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	keys := make([]string, 0, len(idx.data))
-	for k := range idx.data {
-		keys = append(keys, k)
+	keys := make([]string, 0, idx.list.len)
+	for n := idx.list.head.next[0]; n != nil; n = n.next[0] {
+		keys = append(keys, n.key)
 	}
 	return keys
 }
 
+// Range calls fn for every entry in ascending key order until fn returns
+// false
+func (idx *Index) Range(fn func(key string, entry *IndexEntry) bool) {
+	idx.Ascend("", fn)
+}
+
+// Ascend calls fn for every entry whose key is >= from, in ascending key
+// order, until fn returns false. The index is read-locked throughout, so fn
+// must not modify it.
+func (idx *Index) Ascend(from string, fn func(key string, entry *IndexEntry) bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	for n := idx.list.findGE(from, nil); n != nil; n = n.next[0] {
+		if !fn(n.key, n.entry) {
+			return
+		}
+	}
+}
+
 // IsEmpty returns true if index has no keys
 func (idx *Index) IsEmpty() bool {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	return len(idx.data) == 0
+	return idx.list.len == 0
 }
 
 // Clear removes all entries
@@ -91,5 +112,5 @@ func (idx *Index) Clear() {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	idx.data = make(map[string]*IndexEntry)
+	idx.list = newSkipList()
 }
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SegmentEntry is a record of a segment as InspectSegment finds it, or a
+// stretch of damage where no record could be read
+type SegmentEntry struct {
+	Offset uint64
+	Size   uint64  // Bytes the record or the damage takes up
+	Record *Record // nil if nothing could be decoded
+	Err    error   // nil for an intact record
+
+	// Codec the value was stored with, which Record no longer shows once
+	// the value is decompressed
+	Codec Compression
+}
+
+// InspectSegment reads the segment or large object file at path and calls
+// fn for every record in it, intact or not, in file order, for tools that
+// look into the on-disk format. Past damage it resumes at the next intact
+// record. A record that fails its checksum still comes with the fields as
+// read. Intact records are decompressed, and decrypted when opts supply
+// the key; without it they stay sealed, with a non-zero KeyID.
+func InspectSegment(path string, fn func(SegmentEntry) error, opts ...Option) error {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return walkSegment(data, func(offset, size uint64, rec *Record, err error) error {
+		entry := SegmentEntry{Offset: offset, Size: size, Record: rec}
+		if rec != nil {
+			entry.Codec = rec.Codec
+		}
+		if err == nil && (rec.Op == OpSet || rec.Op == OpDelete || rec.Op == OpChunk) {
+			if openErr := o.keyring.openRecord(rec); !errors.Is(openErr, ErrMissingKey) {
+				err = openErr
+			}
+			if err == nil && rec.KeyID == 0 {
+				err = decompressRecord(rec)
+			}
+		}
+		entry.Err = err
+		return fn(entry)
+	})
+}
+
+// SnapshotInfo is the contents of an index snapshot file
+type SnapshotInfo struct {
+	Index *Index
+	Seq   uint64 // Sequence number when the snapshot was taken
+
+	// The snapshot covers every record before Offset in Segment. Segment
+	// is 0 for an index in the original format, which records neither.
+	Segment uint64
+	Offset  uint64
+}
+
+// InspectSnapshot reads the index snapshot file at path. opts supply the
+// keyring of an encrypted store.
+func InspectSnapshot(path string, opts ...Option) (*SnapshotInfo, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	snap, err := readSnapshotFile(path, o.keyring)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotInfo{Index: snap.index, Seq: snap.seq, Segment: snap.segment, Offset: snap.offset}, nil
+}
+
+// walkSegment calls fn for every record of a segment held in memory with
+// its offset and size. Damage is passed to fn as an error along with the
+// bytes up to the next intact record, where the walk resumes.
+func walkSegment(data []byte, fn func(offset, size uint64, rec *Record, err error) error) error {
+	size := uint64(len(data))
+	for offset := uint64(0); offset < size; {
+		rec, err := readRecordAt(data, offset)
+		if err == nil {
+			recSize := uint64(storedSize(rec))
+			if err := fn(offset, recSize, rec, nil); err != nil {
+				return err
+			}
+			offset += recSize
+			continue
+		}
+
+		next := nextRecord(data, offset+1)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			if next == size {
+				err = fmt.Errorf("truncated tail: %w", err)
+			} else {
+				err = fmt.Errorf("%w: record runs past the end of the segment", ErrCorrupted)
+			}
+		}
+		if err := fn(offset, next-offset, rec, err); err != nil {
+			return err
+		}
+		offset = next
+	}
+	return nil
+}
+
+// readRecordAt reads the record at offset in a segment held in memory. A
+// damaged length is caught before ReadRecord allocates for it.
+func readRecordAt(data []byte, offset uint64) (*Record, error) {
+	rest := data[offset:]
+	if indexMagic(rest) == 0 && !fitsRecord(rest) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return ReadRecord(bytes.NewReader(rest))
+}
+
+// nextRecord returns the offset of the first intact record at or after
+// from, or the length of data if there is none
+func nextRecord(data []byte, from uint64) uint64 {
+	if pos := findIntactRecord(data[from:]); pos >= 0 {
+		return from + uint64(pos)
+	}
+	return uint64(len(data))
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectSegment(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	keys := testKeyring(t, testKey(1))
+
+	store, err := OpenWithOptions(dir, WithKeyring(keys), WithCompression(CompressionDeflate))
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	long := bytes.Repeat([]byte("compressible "), 20)
+	require.NoError(t, store.Set("a", long))
+	require.NoError(t, store.Set("b", []byte("short")))
+	require.NoError(t, store.Delete("a"))
+	require.NoError(t, store.SaveSnapshot())
+
+	damaged, ok := store.index.Get("b")
+	require.True(t, ok)
+	require.NoError(t, store.Close())
+
+	path := segmentPath(dir, 1)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[damaged.Offset+uint64(damaged.Size)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, append(data, 0xF0), 0644))
+
+	var entries []SegmentEntry
+	collect := func(e SegmentEntry) error {
+		entries = append(entries, e)
+		return nil
+	}
+
+	require.NoError(t, InspectSegment(path, collect, WithKeyring(keys)))
+	require.Len(t, entries, 4)
+
+	assert.NoError(t, entries[0].Err)
+	assert.Equal(t, CompressionDeflate, entries[0].Codec)
+	assert.Equal(t, "a", entries[0].Record.Key)
+	assert.Equal(t, long, entries[0].Record.Value)
+
+	// A record that fails its checksum is still decoded, but left sealed
+	assert.ErrorIs(t, entries[1].Err, ErrChecksumMismatch)
+	assert.Equal(t, damaged.Offset, entries[1].Offset)
+	assert.Equal(t, uint64(2), entries[1].Record.Seq)
+	assert.Equal(t, uint32(1), entries[1].Record.KeyID)
+
+	assert.NoError(t, entries[2].Err)
+	assert.Equal(t, OpDelete, entries[2].Record.Op)
+	assert.Equal(t, "a", entries[2].Record.Key)
+
+	assert.Nil(t, entries[3].Record)
+	assert.Equal(t, uint64(len(data)), entries[3].Offset)
+	assert.Equal(t, uint64(1), entries[3].Size)
+	assert.ErrorIs(t, entries[3].Err, io.ErrUnexpectedEOF)
+
+	// Without the key records stay sealed
+	entries = nil
+	require.NoError(t, InspectSegment(path, collect))
+	assert.NoError(t, entries[0].Err)
+	assert.Equal(t, uint32(1), entries[0].Record.KeyID)
+	assert.NotEqual(t, "a", entries[0].Record.Key)
+
+	info, err := InspectSnapshot(filepath.Join(dir, snapshotFile), WithKeyring(keys))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), info.Seq)
+	assert.Equal(t, []string{"b"}, info.Index.Keys())
+	_, err = InspectSnapshot(filepath.Join(dir, snapshotFile))
+	assert.ErrorIs(t, err, ErrMissingKey)
+}
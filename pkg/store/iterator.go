@@ -0,0 +1,168 @@
+package store
+
+// IteratorOptions limits the keys an Iterator visits. Bounds combine with
+// Prefix; the empty string leaves a bound open.
+type IteratorOptions struct {
+	Prefix     string // Only visit keys starting with Prefix
+	LowerBound string // Inclusive lower bound
+	UpperBound string // Exclusive upper bound
+}
+
+// Iterator walks keys in ascending order without materialising the
+// keyspace. It holds no locks between calls: every move looks up the next
+// key in the live index, so concurrent writes are safe and are seen if they
+// land ahead of the iterator. An iterator over a Snapshot sees no
+// concurrent writes at all. Values are read lazily.
+type Iterator struct {
+	store *KVStore
+	snap  *Snapshot // nil for the live store
+	lower string
+	upper string // "" for none
+
+	key   string
+	valid bool
+	err   error
+}
+
+// NewIterator returns an iterator positioned at the first key in range
+func (s *KVStore) NewIterator(opts IteratorOptions) *Iterator {
+	return newIterator(s, nil, opts)
+}
+
+func newIterator(s *KVStore, snap *Snapshot, opts IteratorOptions) *Iterator {
+	it := &Iterator{
+		store: s,
+		snap:  snap,
+		lower: opts.LowerBound,
+		upper: opts.UpperBound,
+	}
+
+	if opts.Prefix != "" {
+		if opts.Prefix > it.lower {
+			it.lower = opts.Prefix
+		}
+		if end := prefixEnd(opts.Prefix); end != "" && (it.upper == "" || end < it.upper) {
+			it.upper = end
+		}
+	}
+
+	it.Seek("")
+	return it
+}
+
+// Seek moves to the first key in range that is >= key
+func (it *Iterator) Seek(key string) {
+	if key < it.lower {
+		key = it.lower
+	}
+	it.seek(key)
+}
+
+// Next moves to the key after the current one
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	// The smallest string greater than the current key
+	it.seek(it.key + "\x00")
+}
+
+// Valid reports whether the iterator is positioned at a key
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key at the iterator
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value reads the current value of the key at the iterator. It returns
+// ErrNotFound if the key was deleted or expired after the iterator reached
+// it.
+func (it *Iterator) Value() ([]byte, error) {
+	if !it.valid {
+		return nil, ErrNotFound
+	}
+
+	s := it.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entry *IndexEntry
+	var ok bool
+	if it.snap != nil {
+		if it.snap.released {
+			return nil, ErrSnapshotReleased
+		}
+		entry, ok = it.snap.lookup(it.key)
+	} else {
+		entry, ok = s.lookup(it.key)
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	value, err := s.readValue(it.key, entry)
+	if err != nil {
+		it.err = err
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Err returns the first error the iterator ran into
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator
+func (it *Iterator) Close() error {
+	it.valid = false
+	return nil
+}
+
+// seek moves to the first live key >= from that is below the upper bound
+func (it *Iterator) seek(from string) {
+	s := it.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if it.snap != nil {
+		if it.snap.released {
+			it.valid = false
+			it.err = ErrSnapshotReleased
+			return
+		}
+		it.key, it.valid = it.snap.seek(from, it.upper)
+		return
+	}
+
+	now := s.now()
+	it.valid = false
+	s.index.Ascend(from, func(key string, entry *IndexEntry) bool {
+		if it.upper != "" && key >= it.upper {
+			return false
+		}
+		if expired(entry.ExpiresAt, now) {
+			return true
+		}
+		it.key = key
+		it.valid = true
+		return false
+	})
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or "" if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
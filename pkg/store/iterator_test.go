@@ -0,0 +1,121 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func collectKeys(it *Iterator) []string {
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+func TestIndexKeepsKeysSorted(t *testing.T) {
+	idx := NewIndex()
+	want := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%d", rand.Intn(500))
+		if rand.Intn(3) == 0 {
+			idx.Remove(key)
+			delete(want, key)
+		} else {
+			idx.Insert(key, &IndexEntry{Offset: uint64(i)})
+			want[key] = true
+		}
+	}
+
+	var expected []string
+	for key := range want {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+
+	assert.Equal(t, len(expected), idx.Len())
+	assert.Equal(t, expected, idx.Keys())
+}
+
+func TestIterator(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer cleanupTestStore(t, store, dir)
+
+	for _, key := range []string{"user:1", "user:2", "user:3", "order:1", "order:2", "zeta"} {
+		require.NoError(t, store.Set(key, []byte("v-"+key)))
+	}
+
+	it := store.NewIterator(IteratorOptions{})
+	assert.Equal(t, []string{"order:1", "order:2", "user:1", "user:2", "user:3", "zeta"}, collectKeys(it))
+	require.NoError(t, it.Close())
+
+	it = store.NewIterator(IteratorOptions{Prefix: "user:"})
+	require.True(t, it.Valid())
+	val, err := it.Value()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v-user:1"), val)
+	assert.Equal(t, []string{"user:1", "user:2", "user:3"}, collectKeys(it))
+
+	it = store.NewIterator(IteratorOptions{LowerBound: "order:2", UpperBound: "user:3"})
+	assert.Equal(t, []string{"order:2", "user:1", "user:2"}, collectKeys(it))
+
+	it = store.NewIterator(IteratorOptions{Prefix: "user:"})
+	it.Seek("user:2")
+	assert.Equal(t, "user:2", it.Key())
+	it.Seek("a")
+	assert.Equal(t, "user:1", it.Key())
+	it.Seek("user:4")
+	assert.False(t, it.Valid())
+	assert.NoError(t, it.Err())
+}
+
+func TestIteratorWithConcurrentWrites(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer cleanupTestStore(t, store, dir)
+
+	for i := 0; i < 200; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%03d", i), []byte("x")))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i += 2 {
+			assert.NoError(t, store.Delete(fmt.Sprintf("key%03d", i)))
+			assert.NoError(t, store.Set(fmt.Sprintf("key%03d-new", i), []byte("y")))
+		}
+	}()
+
+	it := store.NewIterator(IteratorOptions{Prefix: "key"})
+	prev := ""
+	seen := 0
+	for ; it.Valid(); it.Next() {
+		assert.Greater(t, it.Key(), prev)
+		prev = it.Key()
+		if _, err := it.Value(); err != nil {
+			assert.ErrorIs(t, err, ErrNotFound)
+		}
+		seen++
+	}
+	wg.Wait()
+	assert.NoError(t, it.Err())
+
+	// Every odd key was never touched and must have been visited
+	assert.GreaterOrEqual(t, seen, 100)
+	it = store.NewIterator(IteratorOptions{Prefix: "key"})
+	assert.Len(t, collectKeys(it), 200)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, "b", prefixEnd("a"))
+	assert.Equal(t, "ab", prefixEnd("aa"))
+	assert.Equal(t, "b", prefixEnd("a\xff"))
+	assert.Equal(t, "", prefixEnd("\xff\xff"))
+}
@@ -0,0 +1,781 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values larger than the large value threshold are kept out of the
+// segments, each in a file of its own named after the version of the set
+// that stored it. The file is a run of chunk records holding the value in
+// order; the set record in the segment only describes the file. Replacing
+// or deleting the value retires the file, which is removed once the write
+// that retired it is durable and no snapshot can still read it. Compaction
+// reseals files under a rotated-in key as a new generation of the file
+// and retires the old one the same way.
+
+const (
+	largePrefix    = "large-"
+	largeTmpSuffix = ".tmp"
+
+	// Value bytes per chunk of a large object file
+	largeChunkSize = 1024 * 1024
+)
+
+// largeObject describes a large object file. Its encoding is the value of
+// the set record that refers to the file.
+type largeObject struct {
+	size      uint64 // Length of the value
+	stored    uint64 // Length of the file
+	chunkSize uint32 // Value bytes per chunk; only the last one holds fewer
+	gen       uint32 // Generation of the file, bumped when it is resealed
+}
+
+// largeObjectSize is the length of an encoded largeObject
+const largeObjectSize = 8 + 8 + 4 + 4
+
+func (obj largeObject) encode() []byte {
+	buf := make([]byte, 0, largeObjectSize)
+	buf = binary.LittleEndian.AppendUint64(buf, obj.size)
+	buf = binary.LittleEndian.AppendUint64(buf, obj.stored)
+	buf = binary.LittleEndian.AppendUint32(buf, obj.chunkSize)
+	return binary.LittleEndian.AppendUint32(buf, obj.gen)
+}
+
+func decodeLargeObject(data []byte) (largeObject, error) {
+	if len(data) != largeObjectSize {
+		return largeObject{}, fmt.Errorf("%w: large object reference of %d bytes", ErrCorrupted, len(data))
+	}
+	obj := largeObject{
+		size:      binary.LittleEndian.Uint64(data[0:8]),
+		stored:    binary.LittleEndian.Uint64(data[8:16]),
+		chunkSize: binary.LittleEndian.Uint32(data[16:20]),
+		gen:       binary.LittleEndian.Uint32(data[20:24]),
+	}
+	if obj.chunkSize == 0 {
+		return largeObject{}, fmt.Errorf("%w: large object with empty chunks", ErrCorrupted)
+	}
+	return obj, nil
+}
+
+// clampSize narrows a size to the uint32 the index keeps sizes in
+func clampSize(size uint64) uint32 {
+	if size > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(size)
+}
+
+// largeFile names a large object file: the version of the set that stored
+// the value, and how many times compaction has resealed it since
+type largeFile struct {
+	version uint64
+	gen     uint32
+}
+
+// retiredLarge is a large object file waiting for the write with the given
+// durability ticket, which replaced or deleted its value
+type retiredLarge struct {
+	file   largeFile
+	ticket uint64
+}
+
+// PutReader stores the value read from r under key. size is the length of
+// the value, or -1 if it is not known up front; exactly size bytes are
+// read, and a reader that runs out sooner fails with io.ErrUnexpectedEOF.
+// Values above the large value threshold are streamed to disk in chunks
+// rather than held in memory; see WithLargeValueThreshold.
+func (s *KVStore) PutReader(key string, r io.Reader, size int64) error {
+	return s.putReader(key, r, size, 0)
+}
+
+// PutReaderWithTTL stores the value read from r like PutReader and makes
+// it expire after ttl
+func (s *KVStore) PutReaderWithTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return s.putReader(key, r, size, ttl)
+}
+
+// putReader stores the value read from r, expiring ttl after it has been
+// written (0 for never)
+func (s *KVStore) putReader(key string, r io.Reader, size int64, ttl time.Duration) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	if size < 0 || uint64(size) <= s.largeThreshold {
+		// Read up to the threshold to find out whether the value is small
+		// enough to go into a segment after all
+		head, err := io.ReadAll(io.LimitReader(r, int64(s.largeThreshold)+1))
+		if err != nil {
+			return err
+		}
+		if uint64(len(head)) <= s.largeThreshold {
+			if size >= 0 && int64(len(head)) != size {
+				return io.ErrUnexpectedEOF
+			}
+			return s.putValue(key, head, ttl)
+		}
+		r = io.MultiReader(bytes.NewReader(head), r)
+	}
+
+	tmpPath, obj, err := s.writeLarge(key, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && obj.size != uint64(size) {
+		_ = os.Remove(tmpPath)
+		return io.ErrUnexpectedEOF
+	}
+
+	s.mu.Lock()
+	ticket, err := s.setLarge(key, tmpPath, obj, ttl)
+	s.mu.Unlock()
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return s.waitDurable(ticket)
+}
+
+// putValue stores a value read into memory by putReader
+func (s *KVStore) putValue(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = s.now().Add(ttl).UnixNano()
+	}
+	ticket, err := s.set(key, value, expiresAt)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.waitDurable(ticket)
+}
+
+// writeLarge streams the value read from r into a new large object file
+// for key, fsyncs it and returns its temporary path and description
+func (s *KVStore) writeLarge(key string, r io.Reader) (string, largeObject, error) {
+	file, err := os.CreateTemp(s.baseDir, largePrefix+"*"+largeTmpSuffix)
+	if err != nil {
+		return "", largeObject{}, err
+	}
+	fail := func(err error) (string, largeObject, error) {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return "", largeObject{}, err
+	}
+
+	w := bufio.NewWriter(file)
+	obj := largeObject{chunkSize: largeChunkSize}
+	buf := make([]byte, largeChunkSize)
+	for seq := uint64(0); ; seq++ {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			rec := compressRecord(&Record{Op: OpChunk, Seq: seq, Key: key, Value: buf[:n]}, s.compression)
+			sealed, err := s.keys.sealRecord(rec)
+			if err != nil {
+				return fail(err)
+			}
+			if err := WriteRecord(w, sealed); err != nil {
+				return fail(err)
+			}
+			obj.size += uint64(n)
+			obj.stored += uint64(recordSize(sealed))
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return fail(readErr)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return "", largeObject{}, err
+	}
+	return file.Name(), obj, nil
+}
+
+// setLarge installs the large object file at tmpPath under the next
+// version and appends the set record that refers to it. It returns the
+// write's durability ticket; callers hold s.mu.
+func (s *KVStore) setLarge(key, tmpPath string, obj largeObject, ttl time.Duration) (uint64, error) {
+	s.seq++
+	version := s.seq
+	path := largePath(s.baseDir, version, obj.gen)
+	if err := os.Rename(tmpPath, path); err != nil {
+		return 0, err
+	}
+	// The file has to be in place before anything refers to it
+	if err := syncDir(s.baseDir); err != nil {
+		_ = os.Remove(path)
+		return 0, err
+	}
+
+	rec := &Record{Op: OpSet, Seq: version, Key: key, Value: obj.encode(), Large: true}
+	if ttl > 0 {
+		rec.ExpiresAt = s.now().Add(ttl).UnixNano()
+	}
+	entry, err := s.appendRecord(rec)
+	if err != nil {
+		_ = os.Remove(path)
+		return 0, err
+	}
+	ticket := s.written
+
+	s.large[version] = obj.gen
+	s.applySet(key, entry)
+
+	if s.activeOffset >= s.maxSegmentSize {
+		if err := s.rotateSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	return ticket, nil
+}
+
+// OpenValue returns a reader over the value of key. Large values are read
+// from disk a chunk at a time as the reader is used, so they never have to
+// fit in memory; the reader keeps working if the key is overwritten or
+// deleted meanwhile. The caller must close it.
+func (s *KVStore) OpenValue(key string) (io.ReadSeekCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.lookup(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	rec, err := s.readRecordAt(key, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !rec.Large {
+		return valueReader{bytes.NewReader(rec.Value)}, nil
+	}
+	return s.openLarge(key, rec)
+}
+
+// valueReader is the reader OpenValue returns for a value held in a
+// segment, which is read into memory whole
+type valueReader struct {
+	*bytes.Reader
+}
+
+func (valueReader) Close() error {
+	return nil
+}
+
+// readValue reads the value an index entry points to, loading it from its
+// large object file if it has one
+func (s *KVStore) readValue(key string, entry *IndexEntry) ([]byte, error) {
+	rec, err := s.readRecordAt(key, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !rec.Large {
+		return rec.Value, nil
+	}
+
+	r, err := s.openLarge(key, rec)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	value := make([]byte, r.obj.size)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// openLarge opens the large object file a set record refers to
+func (s *KVStore) openLarge(key string, rec *Record) (*largeReader, error) {
+	obj, err := decodeLargeObject(rec.Value)
+	if err != nil {
+		return nil, fmt.Errorf("read large object %d: %w", rec.Seq, err)
+	}
+	file, err := os.Open(largePath(s.baseDir, rec.Seq, obj.gen))
+	if err != nil {
+		return nil, fmt.Errorf("read large object %d: %w", rec.Seq, err)
+	}
+	return &largeReader{
+		file:    file,
+		key:     key,
+		version: rec.Seq,
+		keys:    s.keys,
+		obj:     obj,
+		offsets: []uint64{0},
+		loaded:  -1,
+	}, nil
+}
+
+// largeReader reads a large object file one chunk at a time
+type largeReader struct {
+	file    *os.File
+	key     string
+	version uint64
+	keys    *Keyring
+	obj     largeObject
+
+	offsets []uint64 // File offsets of the chunks found so far
+	pos     int64    // Position in the value
+	chunk   []byte   // Value bytes of the chunk last loaded
+	loaded  int64    // Number of that chunk, -1 for none
+}
+
+func (r *largeReader) Read(p []byte) (int, error) {
+	if r.pos >= int64(r.obj.size) {
+		return 0, io.EOF
+	}
+
+	n := int64(r.obj.chunkSize)
+	if i := r.pos / n; i != r.loaded {
+		if err := r.load(i); err != nil {
+			return 0, fmt.Errorf("read large object %d chunk %d: %w", r.version, i, err)
+		}
+	}
+	read := copy(p, r.chunk[r.pos%n:])
+	r.pos += int64(read)
+	return read, nil
+}
+
+func (r *largeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += int64(r.obj.size)
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *largeReader) Close() error {
+	return r.file.Close()
+}
+
+// load reads, checks and decodes chunk i
+func (r *largeReader) load(i int64) error {
+	// Chunks vary in length once compressed or sealed, so they are found
+	// by hopping from one header to the next
+	for int64(len(r.offsets)) <= i {
+		last := r.offsets[len(r.offsets)-1]
+		size, err := r.recordSizeAt(last)
+		if err != nil {
+			return err
+		}
+		r.offsets = append(r.offsets, last+size)
+	}
+
+	offset := r.offsets[i]
+	size, err := r.recordSizeAt(offset)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := r.file.ReadAt(buf, int64(offset)); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	rec, err := ReadRecord(bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	if err := r.keys.openRecord(rec); err != nil {
+		return err
+	}
+	if err := decompressRecord(rec); err != nil {
+		return err
+	}
+
+	want := uint64(r.obj.chunkSize)
+	if rest := r.obj.size - uint64(i)*want; rest < want {
+		want = rest
+	}
+	if rec.Op != OpChunk || rec.Seq != uint64(i) || rec.Key != r.key || uint64(len(rec.Value)) != want {
+		return ErrCorrupted
+	}
+
+	r.chunk = rec.Value
+	r.loaded = i
+	return nil
+}
+
+// recordSizeAt returns the size of the chunk record at offset from its
+// header, refusing one that would run past the end of the file
+func (r *largeReader) recordSizeAt(offset uint64) (uint64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := r.file.ReadAt(header, int64(offset)); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if header[0] != MagicV2[0] || header[1] != MagicV2[1] {
+		return 0, ErrInvalidMagic
+	}
+	if header[3]&^knownFlags != 0 {
+		return 0, ErrCorrupted
+	}
+
+	keyLen := uint64(binary.LittleEndian.Uint32(header[12:16]))
+	valLen := uint64(binary.LittleEndian.Uint32(header[16:20]))
+	size := uint64(recordHeaderSize+optionalFieldsSize(header[3])) + keyLen + valLen + 4
+	if offset+size > r.obj.stored {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return size, nil
+}
+
+// retireLarge schedules the large object file an index entry refers to, if
+// any, for removal once the latest write is durable; callers hold s.mu for
+// writing
+func (s *KVStore) retireLarge(entry *IndexEntry) {
+	gen, ok := s.large[entry.Version]
+	if !ok {
+		return
+	}
+	delete(s.large, entry.Version)
+	s.retired = append(s.retired, retiredLarge{file: largeFile{entry.Version, gen}, ticket: s.written})
+}
+
+// replaceLarge switches a live large object over to a resealed generation
+// of its file and retires the previous one; callers hold s.mu for writing
+func (s *KVStore) replaceLarge(f largeFile) {
+	old := largeFile{f.version, s.large[f.version]}
+	s.large[f.version] = f.gen
+	s.retired = append(s.retired, retiredLarge{file: old, ticket: s.written})
+}
+
+// removeRetired deletes the retired large object files whose replacing
+// write is durable, unless a snapshot is open and may still read them
+func (s *KVStore) removeRetired() {
+	s.mu.RLock()
+	pending := len(s.retired) > 0
+	s.mu.RUnlock()
+	if !pending {
+		return
+	}
+
+	synced := s.commits.durable()
+	s.mu.Lock()
+	files := s.takeRetired(synced)
+	s.mu.Unlock()
+	s.removeLarge(files)
+}
+
+// takeRetired removes the retired large objects whose replacing write has
+// a ticket no later than synced from the list and returns their files;
+// callers hold s.mu for writing
+func (s *KVStore) takeRetired(synced uint64) []largeFile {
+	if len(s.snapshots) > 0 {
+		return nil
+	}
+
+	var done []largeFile
+	keep := s.retired[:0]
+	for _, r := range s.retired {
+		if r.ticket <= synced {
+			done = append(done, r.file)
+		} else {
+			keep = append(keep, r)
+		}
+	}
+	s.retired = keep
+	return done
+}
+
+// removeLarge deletes large object files. A file left behind is only
+// wasted space, which the next Open reclaims.
+func (s *KVStore) removeLarge(files []largeFile) {
+	for _, f := range files {
+		if err := os.Remove(largePath(s.baseDir, f.version, f.gen)); err != nil && !os.IsNotExist(err) {
+			s.logger.Warn("failed to remove large object", "version", f.version, "gen", f.gen, "err", err)
+			continue
+		}
+		s.logger.Debug("removed large object", "version", f.version, "gen", f.gen)
+	}
+}
+
+// loadLarge finds the large object files the index refers to and removes
+// the rest: files retired before they could be removed, and files a crash
+// left without the record that would have referred to them
+func (s *KVStore) loadLarge() error {
+	files, err := findLarge(s.baseDir)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	live := make(map[uint64]string, s.index.Len())
+	s.index.Range(func(key string, entry *IndexEntry) bool {
+		live[entry.Version] = key
+		return true
+	})
+
+	var stale []largeFile
+	for i := 0; i < len(files); {
+		// Generations of a version are adjacent
+		j := i + 1
+		for j < len(files) && files[j].version == files[i].version {
+			j++
+		}
+		gens := files[i:j]
+		i = j
+
+		key, ok := live[gens[0].version]
+		if !ok {
+			stale = append(stale, gens...)
+			continue
+		}
+		gen := gens[0].gen
+		if len(gens) > 1 {
+			// A compaction that resealed the file did not get to retire
+			// one generation or the other; the set record says which
+			gen, err = s.liveGen(key)
+			if err != nil {
+				return fmt.Errorf("large object %d: %w", gens[0].version, err)
+			}
+		}
+		s.large[gens[0].version] = gen
+		for _, f := range gens {
+			if f.gen != gen {
+				stale = append(stale, f)
+			}
+		}
+	}
+	s.removeLarge(stale)
+	return nil
+}
+
+// liveGen returns the generation of the large object file the value of key
+// is in
+func (s *KVStore) liveGen(key string) (uint32, error) {
+	entry, ok := s.index.Get(key)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	rec, err := s.readRecordAt(key, entry)
+	if err != nil {
+		return 0, err
+	}
+	obj, err := decodeLargeObject(rec.Value)
+	if err != nil {
+		return 0, err
+	}
+	return obj.gen, nil
+}
+
+// liveLarge returns the large object files the index refers to in
+// ascending order; callers hold s.mu
+func (s *KVStore) liveLarge() []largeFile {
+	files := make([]largeFile, 0, len(s.large))
+	for version, gen := range s.large {
+		files = append(files, largeFile{version, gen})
+	}
+	sortLarge(files)
+	return files
+}
+
+// resealLarge rewrites the large object file of a set record as its next
+// generation if it is not sealed with the active key, so that compaction
+// moves large values off rotated keys along with the segments. rec's value
+// is updated to describe the new file, which is returned; nil means the
+// file was left as it is.
+func (s *KVStore) resealLarge(rec *Record) (*largeFile, error) {
+	if !rec.Large || s.keys == nil {
+		return nil, nil
+	}
+	obj, err := decodeLargeObject(rec.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(largePath(s.baseDir, rec.Seq, obj.gen))
+	if os.IsNotExist(err) {
+		// The value was replaced meanwhile, and compaction drops it
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Every chunk is sealed with the same key, so the first one tells
+	r, err := newSizedReader(file, -1)
+	if err != nil {
+		return nil, err
+	}
+	first, err := ReadRecord(r)
+	if err != nil {
+		return nil, fmt.Errorf("chunk 0: %w", err)
+	}
+	if first.KeyID == s.keys.ActiveID() {
+		return nil, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	out, err := os.CreateTemp(s.baseDir, largePrefix+"*"+largeTmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*largeFile, error) {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return nil, err
+	}
+
+	w := bufio.NewWriter(out)
+	obj.stored = 0
+	err = scanLarge(file, func(chunk *Record) error {
+		if err := s.keys.openRecord(chunk); err != nil {
+			return err
+		}
+		if chunk.Key != rec.Key {
+			return ErrCorrupted
+		}
+		sealed, err := s.keys.sealRecord(chunk)
+		if err != nil {
+			return err
+		}
+		obj.stored += uint64(recordSize(sealed))
+		return WriteRecord(w, sealed)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(out.Name())
+		return nil, err
+	}
+
+	obj.gen++
+	f := largeFile{rec.Seq, obj.gen}
+	if err := os.Rename(out.Name(), largePath(s.baseDir, f.version, f.gen)); err != nil {
+		_ = os.Remove(out.Name())
+		return nil, err
+	}
+	rec.Value = obj.encode()
+	return &f, nil
+}
+
+// scanLarge calls fn for every chunk of a large object file, failing on
+// anything that is not the next chunk, including a torn tail
+func scanLarge(file *os.File, fn func(rec *Record) error) error {
+	r, err := newSizedReader(file, -1)
+	if err != nil {
+		return err
+	}
+	for seq := uint64(0); ; seq++ {
+		rec, err := ReadRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", seq, err)
+		}
+		if rec.Op != OpChunk || rec.Seq != seq {
+			return fmt.Errorf("chunk %d: %w: found op %d seq %d", seq, ErrCorrupted, rec.Op, rec.Seq)
+		}
+		if fn != nil {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// largePath returns the path of a large object file. The first generation
+// goes without a generation number.
+func largePath(dir string, version uint64, gen uint32) string {
+	if gen == 0 {
+		return filepath.Join(dir, fmt.Sprintf("%s%d%s", largePrefix, version, segmentSuffix))
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s%d-%d%s", largePrefix, version, gen, segmentSuffix))
+}
+
+// parseLargeName returns the large object file with the given name
+func parseLargeName(name string) (largeFile, bool) {
+	if !strings.HasPrefix(name, largePrefix) || !strings.HasSuffix(name, segmentSuffix) {
+		return largeFile{}, false
+	}
+	versionPart, genPart, resealed := strings.Cut(name[len(largePrefix):len(name)-len(segmentSuffix)], "-")
+	version, err := strconv.ParseUint(versionPart, 10, 64)
+	if err != nil {
+		return largeFile{}, false
+	}
+	if !resealed {
+		return largeFile{version: version}, true
+	}
+	gen, err := strconv.ParseUint(genPart, 10, 32)
+	if err != nil || gen == 0 {
+		return largeFile{}, false
+	}
+	return largeFile{version, uint32(gen)}, true
+}
+
+// findLarge returns the large object files in dir in ascending order
+func findLarge(dir string) ([]largeFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []largeFile
+	for _, entry := range entries {
+		if f, ok := parseLargeName(entry.Name()); ok {
+			files = append(files, f)
+		}
+	}
+	sortLarge(files)
+	return files, nil
+}
+
+// sortLarge orders large object files by version, then generation
+func sortLarge(files []largeFile) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].version != files[j].version {
+			return files[i].version < files[j].version
+		}
+		return files[i].gen < files[j].gen
+	})
+}
@@ -0,0 +1,356 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largeValue returns n bytes that do not repeat within a chunk
+func largeValue(n int) []byte {
+	value := make([]byte, n)
+	for i := range value {
+		value[i] = byte(i*7 + i/251)
+	}
+	return value
+}
+
+// largeFiles returns the large object files in dir
+func largeFiles(t *testing.T, dir string) []largeFile {
+	t.Helper()
+	files, err := findLarge(dir)
+	require.NoError(t, err)
+	return files
+}
+
+func TestPutReaderLarge(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	store, err := OpenWithOptions(dir, WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	value := largeValue(2*largeChunkSize + 12345)
+	require.NoError(t, store.PutReader("big", bytes.NewReader(value), int64(len(value))))
+	require.NoError(t, store.PutReader("small", strings.NewReader("inline"), -1))
+
+	// Only the large value got a file of its own
+	files := largeFiles(t, dir)
+	require.Len(t, files, 1)
+	entry, ok := store.index.Get("big")
+	require.True(t, ok)
+	assert.Equal(t, largeFile{version: entry.Version}, files[0])
+	assert.Equal(t, uint32(len(value)), entry.ValueSize)
+	assert.Less(t, entry.Size, uint32(100))
+
+	got, err := store.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, value, got)
+	got, err = store.Get("small")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("inline"), got)
+
+	// The reader seeks across chunks
+	r, err := store.OpenValue("big")
+	require.NoError(t, err)
+	pos := int64(largeChunkSize - 10)
+	_, err = r.Seek(pos, io.SeekStart)
+	require.NoError(t, err)
+	part := make([]byte, 20)
+	_, err = io.ReadFull(r, part)
+	require.NoError(t, err)
+	assert.Equal(t, value[pos:pos+20], part)
+	end, err := r.Seek(-5, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(value)-5), end)
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, value[len(value)-5:], rest)
+	require.NoError(t, r.Close())
+
+	// Large values survive a restart
+	require.NoError(t, store.Close())
+	store, err = OpenWithOptions(dir, WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	got, err = store.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, value, got)
+
+	// Replacing the value removes its file once the write is durable
+	require.NoError(t, store.Set("big", []byte("now small")))
+	assert.Empty(t, largeFiles(t, dir))
+	got, err = store.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("now small"), got)
+}
+
+func TestPutReaderShortRead(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	store, err := OpenWithOptions(dir, WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	value := largeValue(4096)
+	err = store.PutReader("big", bytes.NewReader(value), 5000)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	err = store.PutReader("small", bytes.NewReader(value[:10]), 20)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = store.Get("big")
+	assert.ErrorIs(t, err, ErrNotFound)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), largePrefix), e.Name())
+	}
+
+	// Only size bytes are read
+	require.NoError(t, store.PutReader("big", bytes.NewReader(value), 2048))
+	got, err := store.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, value[:2048], got)
+}
+
+func TestLargeValueEncryptedAndCompressed(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	keys := testKeyring(t, testKey(1))
+
+	opts := []Option{WithKeyring(keys), WithCompression(CompressionDeflate), WithLargeValueThreshold(1024)}
+	store, err := OpenWithOptions(dir, opts...)
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	value := bytes.Repeat([]byte("compressible "), largeChunkSize/4)
+	require.NoError(t, store.PutReaderWithTTL("big", bytes.NewReader(value), -1, time.Hour))
+	entry, ok := store.index.Get("big")
+	require.True(t, ok)
+	assert.Less(t, entry.StoredSize, entry.ValueSize)
+	assert.NotZero(t, entry.ExpiresAt)
+
+	// Neither the key nor the value shows in the file
+	data, err := os.ReadFile(largePath(dir, entry.Version, 0))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "big")
+	assert.NotContains(t, string(data), "compressible")
+
+	got, err := store.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, value, got)
+	require.NoError(t, store.Close())
+
+	report, err := Check(dir, WithKeyring(keys))
+	require.NoError(t, err)
+	assert.True(t, report.OK(), "%v", report.Problems)
+	assert.Equal(t, 1, report.Large)
+
+	store, err = OpenWithOptions(dir, opts...)
+	require.NoError(t, err)
+	got, err = store.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, value, got)
+}
+
+func TestLargeValueSnapshot(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	store, err := OpenWithOptions(dir, WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	value := largeValue(10000)
+	require.NoError(t, store.PutReader("big", bytes.NewReader(value), -1))
+	snap := store.Snapshot()
+	require.NoError(t, store.Delete("big"))
+
+	// The snapshot still reads the deleted value
+	got, err := snap.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, value, got)
+	assert.Len(t, largeFiles(t, dir), 1)
+
+	snap.Release()
+	assert.Empty(t, largeFiles(t, dir))
+}
+
+func TestLargeValueOpenRemovesStale(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	store, err := OpenWithOptions(dir, WithLargeValueThreshold(1024), WithSyncPolicy(SyncPolicy{Mode: SyncNever}))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	value := largeValue(5000)
+	require.NoError(t, store.PutReader("a", bytes.NewReader(value), -1))
+	require.NoError(t, store.PutReader("b", bytes.NewReader(value), -1))
+	require.NoError(t, store.Delete("a"))
+	// Without fsyncs the replaced file waits for the segment to be sealed
+	assert.Len(t, largeFiles(t, dir), 2)
+
+	// Simulate a crash: the file of a write that never got its record, one
+	// that was still being streamed in, and a resealed generation that
+	// compaction never swapped in
+	entry, ok := store.index.Get("b")
+	require.True(t, ok)
+	require.NoError(t, store.Close())
+	require.NoError(t, os.WriteFile(largePath(dir, 99, 0), []byte("orphan"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, largePrefix+"123"+largeTmpSuffix), nil, 0644))
+	require.NoError(t, os.WriteFile(largePath(dir, entry.Version, 1), []byte("resealed"), 0644))
+
+	store, err = OpenWithOptions(dir, WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	assert.Equal(t, []largeFile{{version: entry.Version}}, largeFiles(t, dir))
+	got, err := store.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, value, got)
+	_, err = os.Stat(filepath.Join(dir, largePrefix+"123"+largeTmpSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLargeValueExpiresOnCompaction(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	now := time.Now()
+	store, err := OpenWithOptions(dir, WithLargeValueThreshold(1024), WithClock(func() time.Time { return now }))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.PutReaderWithTTL("big", bytes.NewReader(largeValue(5000)), 5000, time.Minute))
+	require.Len(t, largeFiles(t, dir), 1)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, store.Compact())
+	require.NoError(t, store.Set("other", []byte("v")))
+	assert.Empty(t, largeFiles(t, dir))
+}
+
+func TestLargeValueKeyRotation(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	defer os.RemoveAll(dir)
+
+	store, err := OpenWithOptions(dir, WithKeyring(testKeyring(t, testKey(1))), WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	value := largeValue(largeChunkSize + 5000)
+	require.NoError(t, store.PutReader("big", bytes.NewReader(value), -1))
+	require.NoError(t, store.Close())
+
+	store, err = OpenWithOptions(dir, WithKeyring(testKeyring(t, testKey(1), testKey(2))), WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	require.NoError(t, store.Compact())
+	require.NoError(t, store.Close())
+
+	// Compaction resealed the file under the new key as its next
+	// generation and removed the old one
+	files := largeFiles(t, dir)
+	require.Len(t, files, 1)
+	assert.Equal(t, uint32(1), files[0].gen)
+	file, err := os.Open(largePath(dir, files[0].version, files[0].gen))
+	require.NoError(t, err)
+	err = scanLarge(file, func(rec *Record) error {
+		assert.Equal(t, uint32(2), rec.KeyID)
+		return nil
+	})
+	file.Close()
+	require.NoError(t, err)
+
+	store, err = OpenWithOptions(dir, WithKeyring(testKeyring(t, testKey(2))), WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	defer store.Close()
+	r, err := store.OpenValue("big")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, value, got)
+}
+
+func TestLargeValueBackupAndCheckpoint(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	restored := dir + "-restored"
+	checkpoint := dir + "-checkpoint"
+	require.NoError(t, os.RemoveAll(restored))
+	require.NoError(t, os.RemoveAll(checkpoint))
+	defer os.RemoveAll(restored)
+	defer os.RemoveAll(checkpoint)
+
+	store, err := OpenWithOptions(dir, WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	value := largeValue(largeChunkSize + 1)
+	require.NoError(t, store.PutReader("big", bytes.NewReader(value), -1))
+	require.NoError(t, store.Set("small", []byte("v")))
+
+	var buf bytes.Buffer
+	require.NoError(t, store.Backup(&buf))
+	require.NoError(t, Restore(&buf, restored))
+	require.NoError(t, store.Checkpoint(checkpoint))
+
+	for _, copyDir := range []string{restored, checkpoint} {
+		copyStore, err := Open(copyDir)
+		require.NoError(t, err)
+		got, err := copyStore.Get("big")
+		require.NoError(t, err, copyDir)
+		assert.Equal(t, value, got, copyDir)
+		require.NoError(t, copyStore.Close())
+	}
+}
+
+func TestCheckLargeValue(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	defer os.RemoveAll(dir + ".damaged")
+	defer os.RemoveAll(dir)
+
+	store, err := OpenWithOptions(dir, WithLargeValueThreshold(1024))
+	require.NoError(t, err)
+	require.NoError(t, store.Set("big", []byte("old")))
+	require.NoError(t, store.PutReader("big", bytes.NewReader(largeValue(5000)), -1))
+	require.NoError(t, store.PutReader("other", bytes.NewReader(largeValue(6000)), -1))
+	entry, ok := store.index.Get("big")
+	require.True(t, ok)
+	require.NoError(t, store.Close())
+
+	// Damage the value of big
+	path := largePath(dir, entry.Version, 0)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	report, err := Check(dir)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 2, "%v", report.Problems)
+	assert.Equal(t, filepath.Base(path), report.Problems[0].File)
+	assert.ErrorIs(t, report.Problems[0].Err, ErrChecksumMismatch)
+	assert.Equal(t, filepath.Base(segmentPath(dir, 1)), report.Problems[1].File)
+	assert.Equal(t, entry.Offset, report.Problems[1].Offset)
+	assert.ErrorIs(t, report.Problems[1].Err, ErrCorrupted)
+
+	// Repair deletes the key rather than bringing back its old value
+	_, err = Repair(dir)
+	require.NoError(t, err)
+	store, err = Open(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.Get("big")
+	assert.ErrorIs(t, err, ErrNotFound)
+	got, err := store.Get("other")
+	require.NoError(t, err)
+	assert.Equal(t, largeValue(6000), got)
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const lockFile = "LOCK"
+
+// dirLock is an advisory lock on a store directory, held by a writable
+// store until it is closed so that no other store appends to the same
+// segments. Read-only stores never take it.
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir takes the lock on dir, failing with ErrLocked while another
+// store, in this process or any other, holds it
+func lockDir(dir string) (*dirLock, error) {
+	path := filepath.Join(dir, lockFile)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock(file); err != nil {
+		file.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return &dirLock{file: file}, nil
+}
+
+// release drops the lock. The LOCK file stays behind; a lock is only held
+// through an open file, so a crashed process never leaves one stuck.
+func (l *dirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	err := funlock(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// flock is a no-op where the flock system call is unavailable: the LOCK
+// file is still created, but nothing stops two stores sharing a directory
+func flock(file *os.File) error {
+	return nil
+}
+
+// funlock drops a lock taken by flock
+func funlock(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer os.RemoveAll(dir)
+	require.NoError(t, store.Set("k", []byte("v")))
+
+	_, err := Open(dir)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// A read-only store can share the directory with its writer
+	reader, err := OpenWithOptions(dir, WithReadOnly())
+	require.NoError(t, err)
+	got, err := reader.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), got)
+	require.NoError(t, reader.Close())
+
+	require.NoError(t, store.Close())
+	_, err = os.Stat(filepath.Join(dir, lockFile))
+	require.NoError(t, err)
+
+	// Closing hands the directory to the next writer
+	store, err = Open(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	got, err = store.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), got)
+}
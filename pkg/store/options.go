@@ -0,0 +1,135 @@
+package store
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Option configures a KVStore opened with OpenWithOptions
+type Option func(*options)
+
+type options struct {
+	syncPolicy        SyncPolicy
+	compression       Compression
+	keyring           *Keyring
+	segmentSize       uint64
+	bloomExpectedKeys uint
+	bloomFPRate       float64
+	readOnly          bool
+	logger            *slog.Logger
+	clock             func() time.Time
+	largeThreshold    uint64
+}
+
+func defaultOptions() options {
+	return options{
+		syncPolicy:        SyncPolicy{Mode: SyncAlways},
+		segmentSize:       16 * 1024 * 1024, // 16 MB
+		bloomExpectedKeys: 50000,
+		bloomFPRate:       0.01,
+		logger:            slog.Default(),
+		clock:             time.Now,
+		largeThreshold:    1024 * 1024, // 1 MB
+	}
+}
+
+// validate rejects option values the store cannot work with
+func (o *options) validate() error {
+	if o.segmentSize == 0 {
+		return fmt.Errorf("segment size must be positive")
+	}
+	if o.bloomExpectedKeys == 0 {
+		return fmt.Errorf("bloom filter capacity must be positive")
+	}
+	if o.bloomFPRate <= 0 || o.bloomFPRate >= 1 {
+		return fmt.Errorf("bloom filter false-positive rate %v is not between 0 and 1", o.bloomFPRate)
+	}
+	if o.logger == nil {
+		return fmt.Errorf("logger must not be nil")
+	}
+	if o.clock == nil {
+		return fmt.Errorf("clock must not be nil")
+	}
+	// Sealing adds a 16-byte tag to the value
+	if o.largeThreshold > maxValueSize-16 {
+		return fmt.Errorf("large value threshold %d does not fit in a record", o.largeThreshold)
+	}
+	return nil
+}
+
+// WithSyncPolicy sets when writes are fsynced (default SyncAlways)
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+	}
+}
+
+// WithCompression sets the codec applied to values written from now on
+// (default CompressionNone). Records already on disk keep their codec.
+func WithCompression(c Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// WithKeyring encrypts everything the store writes with the keyring's
+// active key and lets it read data sealed with any key in the ring
+func WithKeyring(k *Keyring) Option {
+	return func(o *options) {
+		o.keyring = k
+	}
+}
+
+// WithSegmentSize sets the size in bytes at which the active segment is
+// sealed and a new one started (default 16 MB)
+func WithSegmentSize(bytes uint64) Option {
+	return func(o *options) {
+		o.segmentSize = bytes
+	}
+}
+
+// WithBloomFilter sizes the bloom filter for the expected number of keys
+// and the false-positive rate wanted at that size (default 50,000 keys at
+// 1%)
+func WithBloomFilter(expectedKeys uint, falsePositiveRate float64) Option {
+	return func(o *options) {
+		o.bloomExpectedKeys = expectedKeys
+		o.bloomFPRate = falsePositiveRate
+	}
+}
+
+// WithReadOnly opens the store without modifying the directory: no active
+// segment is created, torn tails are skipped rather than truncated, and
+// every write returns ErrReadOnly
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithLogger sets the logger for replay, recovery and background errors
+// (default slog.Default())
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithClock sets the source of the current time used to expire keys
+// (default time.Now)
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.clock = now
+	}
+}
+
+// WithLargeValueThreshold sets the length in bytes above which values
+// stored with PutReader go to a large object file of their own instead of
+// a segment (default 1 MB). They are then streamed to disk rather than
+// held in memory, and may be longer than a segment record allows.
+func WithLargeValueThreshold(bytes uint64) Option {
+	return func(o *options) {
+		o.largeThreshold = bytes
+	}
+}
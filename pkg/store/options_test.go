@@ -0,0 +1,155 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidOptions(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	defer os.RemoveAll(dir)
+
+	for _, opt := range []Option{
+		WithSegmentSize(0),
+		WithBloomFilter(0, 0.01),
+		WithBloomFilter(1000, 0),
+		WithBloomFilter(1000, 1),
+		WithLogger(nil),
+		WithClock(nil),
+	} {
+		_, err := OpenWithOptions(dir, opt)
+		assert.Error(t, err)
+	}
+}
+
+func TestWithSegmentSize(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	store, err := OpenWithOptions(dir, WithSegmentSize(256), WithBloomFilter(100, 0.001))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%02d", i), bytes.Repeat([]byte("v"), 50)))
+	}
+	assert.Greater(t, store.Stats().NumSegments, 3)
+}
+
+func TestWithClock(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	clock := &fakeClock{now: time.Now()}
+	store, err := OpenWithOptions(dir, WithClock(clock.Now))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.SetWithTTL("k", []byte("v"), time.Minute))
+	clock.Advance(2 * time.Minute)
+	_, err = store.Get("k")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestWithLogger(t *testing.T) {
+	store, dir := setupTestStore(t)
+	require.NoError(t, store.Set("k", []byte("v")))
+	require.NoError(t, store.Close())
+	defer os.RemoveAll(dir)
+
+	// A damaged hint file is reported and the segment replayed instead
+	require.NoError(t, os.WriteFile(hintPath(dir, 1), []byte("garbage"), 0644))
+
+	var logs bytes.Buffer
+	store, err := OpenWithOptions(dir, WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.Contains(t, logs.String(), "ignoring hint file")
+	got, err := store.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), got)
+}
+
+func TestWithReadOnly(t *testing.T) {
+	store, dir := setupTestStore(t)
+	require.NoError(t, store.Set("a", []byte("1")))
+	require.NoError(t, store.Set("b", []byte("2")))
+	require.NoError(t, store.Close())
+	defer os.RemoveAll(dir)
+
+	names := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+	before := names()
+
+	store, err := OpenWithOptions(dir, WithReadOnly())
+	require.NoError(t, err)
+
+	got, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), got)
+	assert.ElementsMatch(t, []string{"a", "b"}, store.ListKeys())
+
+	assert.ErrorIs(t, store.Set("c", []byte("3")), ErrReadOnly)
+	assert.ErrorIs(t, store.Delete("a"), ErrReadOnly)
+	b := NewBatch()
+	b.Set("c", []byte("3"))
+	assert.ErrorIs(t, store.Write(b), ErrReadOnly)
+	assert.ErrorIs(t, store.Compact(), ErrReadOnly)
+	assert.ErrorIs(t, store.SaveSnapshot(), ErrReadOnly)
+	require.NoError(t, store.Close())
+
+	assert.Equal(t, before, names())
+
+	_, err = OpenWithOptions(filepath.Join(dir, "missing"), WithReadOnly())
+	assert.Error(t, err)
+}
+
+func TestLogEvents(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	store, err := OpenWithOptions(dir, WithLogger(logger), WithSegmentSize(128))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Set("key", bytes.Repeat([]byte("v"), 40)))
+	}
+	require.NoError(t, store.Compact())
+
+	var events []string
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var line map[string]any
+		require.NoError(t, dec.Decode(&line))
+		events = append(events, line["msg"].(string))
+		if line["msg"] == "compaction finished" {
+			assert.Contains(t, line, "inputs")
+			assert.Contains(t, line, "output_bytes")
+		}
+	}
+	assert.Contains(t, events, "replayed segments")
+	assert.Contains(t, events, "rotated segment")
+	assert.Contains(t, events, "compaction started")
+	assert.Contains(t, events, "compaction finished")
+	assert.Contains(t, events, "saved index snapshot")
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"slices"
+	"time"
+)
+
+// OpenReadOnly opens the store at dir without ever creating or modifying
+// a file in it, so it is safe to point at a live production directory.
+// Writes and compaction fail with ErrReadOnly. The store sees the data as
+// of opening; call Refresh to follow what a writer appends afterwards.
+func OpenReadOnly(dir string, opts ...Option) (*KVStore, error) {
+	return OpenWithOptions(dir, append(opts, WithReadOnly())...)
+}
+
+// Refresh brings a read-only store up to date with the records its
+// writer has appended since it was opened or last refreshed, including
+// segments created since. If the writer compacted in the meantime, the
+// index is rebuilt from the segments now on disk. Open snapshots keep
+// their view, but cannot stop the writer from deleting the segments it
+// reads from. Watchers see the changes Refresh replays, but not those a
+// rebuild picks up. Refresh does nothing on a writable store, which is
+// always up to date.
+func (s *KVStore) Refresh() error {
+	if !s.readOnly {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := findSegments(s.baseDir)
+	if err != nil {
+		return err
+	}
+
+	// Compaction replaces segments at or before the one the store stopped
+	// in; anything else the writer does only adds to the end
+	var seen []uint64
+	for _, segID := range segments {
+		if segID <= s.activeSegmentID {
+			seen = append(seen, segID)
+		}
+	}
+	if !slices.Equal(seen, s.followed) {
+		return s.reload(segments)
+	}
+
+	end, err := s.replay(segments, s.activeSegmentID, s.activeOffset)
+	if err != nil {
+		return err
+	}
+	s.follow(segments, end)
+
+	return nil
+}
+
+// reload replaces a read-only store's state with one replayed from
+// scratch; callers hold s.mu for writing
+func (s *KVStore) reload(segments []uint64) error {
+	start := time.Now()
+	fresh := &KVStore{
+		baseDir:   s.baseDir,
+		index:     NewIndex(),
+		bloom:     NewBloomIndexWithRate(s.bloom.Capacity(), s.bloom.fpRate),
+		segStats:  make(map[uint64]*SegmentStats),
+		keys:      s.keys,
+		readOnly:  true,
+		logger:    s.logger,
+		snapshots: make(map[*Snapshot]struct{}),
+	}
+	end, err := fresh.replay(segments, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	// Record what open snapshots saw of every key the reload changes
+	if len(s.snapshots) > 0 {
+		s.index.Range(func(key string, entry *IndexEntry) bool {
+			if now, ok := fresh.index.Get(key); !ok || *now != *entry {
+				s.preserve(key)
+			}
+			return true
+		})
+		fresh.index.Range(func(key string, _ *IndexEntry) bool {
+			if _, ok := s.index.Get(key); !ok {
+				s.preserve(key)
+			}
+			return true
+		})
+	}
+
+	s.index = fresh.index
+	s.bloom = fresh.bloom
+	s.seq = fresh.seq
+	s.segStats = fresh.segStats
+
+	// Compaction can reuse a segment ID for its output
+	s.closeReaders()
+	s.follow(segments, end)
+
+	s.logger.Info("reloaded read-only store",
+		"dir", s.baseDir, "segments", len(segments), "keys", s.index.Len(), "duration", time.Since(start))
+	return nil
+}
+
+// follow records that a read-only store has replayed segments up to end in
+// the last of them
+func (s *KVStore) follow(segments []uint64, end uint64) {
+	s.followed = segments
+	if n := len(segments); n > 0 {
+		s.activeSegmentID = segments[n-1]
+		s.activeOffset = end
+	}
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertSameContents checks that reader sees exactly what writer holds
+func assertSameContents(t *testing.T, writer, reader *KVStore) {
+	t.Helper()
+
+	keys := writer.ListKeys()
+	assert.ElementsMatch(t, keys, reader.ListKeys())
+	for _, key := range keys {
+		want, wantVersion, err := writer.GetWithVersion(key)
+		require.NoError(t, err)
+		got, version, err := reader.GetWithVersion(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, want, got, key)
+		assert.Equal(t, wantVersion, version, key)
+	}
+}
+
+func TestOpenReadOnlyFollowsWriter(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	writer, err := OpenWithOptions(dir, WithSegmentSize(256))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, writer, dir) }()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, writer.Set(fmt.Sprintf("key%02d", i), bytes.Repeat([]byte("a"), 40)))
+	}
+
+	reader, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	defer reader.Close()
+	assertSameContents(t, writer, reader)
+	assert.ErrorIs(t, reader.Set("x", []byte("y")), ErrReadOnly)
+	assert.ErrorIs(t, reader.Delete("key00"), ErrReadOnly)
+	assert.ErrorIs(t, reader.Compact(), ErrReadOnly)
+	_, err = reader.SetIfAbsent("x", []byte("y"))
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorIs(t, reader.DeleteIfVersion("x", 0), ErrReadOnly)
+
+	// Appends to the segment the reader stopped in and to new segments
+	for i := 5; i < 30; i++ {
+		require.NoError(t, writer.Set(fmt.Sprintf("key%02d", i), bytes.Repeat([]byte("b"), 40)))
+	}
+	require.NoError(t, writer.Delete("key01"))
+	b := NewBatch()
+	b.Set("batched", []byte("v"))
+	b.Delete("key02")
+	require.NoError(t, writer.Write(b))
+
+	_, err = reader.Get("key29")
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, reader.Refresh())
+	assertSameContents(t, writer, reader)
+
+	require.NoError(t, reader.Refresh())
+	assertSameContents(t, writer, reader)
+}
+
+func TestRefreshAfterCompaction(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	writer, err := OpenWithOptions(dir, WithSegmentSize(256))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, writer, dir) }()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, writer.Set(fmt.Sprintf("key%02d", i), bytes.Repeat([]byte("a"), 40)))
+	}
+
+	reader, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	// The reader never sees these writes before compaction folds them
+	// away, so only a rebuild can notice key03 is gone
+	require.NoError(t, writer.Delete("key03"))
+	require.NoError(t, writer.Set("key05", []byte("changed")))
+	require.NoError(t, writer.Compact())
+	require.NoError(t, writer.Set("after", []byte("compaction")))
+
+	require.NoError(t, reader.Refresh())
+	assertSameContents(t, writer, reader)
+	_, err = reader.Get("key03")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Compacting an empty active segment reuses its ID for the output,
+	// which the reader may have been following
+	require.NoError(t, writer.Compact())
+	require.NoError(t, reader.Refresh())
+	require.NoError(t, writer.Compact())
+	require.NoError(t, reader.Refresh())
+	assertSameContents(t, writer, reader)
+}
+
+func TestOpenReadOnlyMissingDir(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	_, err := OpenReadOnly(dir)
+	assert.Error(t, err)
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,74 +1,155 @@
 package store
 
 import (
+	"bufio"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
+	"os"
+	"time"
 )
 
 // Record opcodes
 const (
 	OpSet    byte = 1
 	OpDelete byte = 2
+
+	// Batch markers frame the records of a Batch. Their value holds the
+	// number of records in the batch as a little-endian uint32.
+	OpBatchBegin  byte = 3
+	OpBatchCommit byte = 4
+
+	// Chunks make up the files of large objects and never appear in
+	// segments. Each holds the next part of the value, and its sequence
+	// number is its position in the file, starting from 0.
+	OpChunk byte = 5
 )
 
-// Magic bytes for record framing
-var Magic = [2]byte{0xF0, 0xF1}
+// Record flags, stored in the version 2 header. Each flag adds an optional
+// field between the header and the key.
+const (
+	flagExpires    byte = 1 << 0 // 8-byte expiry time follows the header
+	flagCompressed byte = 1 << 1 // 1-byte codec and 4-byte decoded length follow
+	flagEncrypted  byte = 1 << 2 // 4-byte key ID and 12-byte nonce follow
+	flagLarge      byte = 1 << 3 // The value describes a large object; no field follows
+
+	knownFlags = flagExpires | flagCompressed | flagEncrypted | flagLarge
+)
+
+// Magic bytes for record framing. Version 1 records have no sequence
+// number; every record written today uses MagicV2.
+var (
+	Magic   = [2]byte{0xF0, 0xF1}
+	MagicV2 = [2]byte{0xF0, 0xF2}
+)
 
 // Record represents a single key-value operation
 type Record struct {
 	Op    byte
+	Seq   uint64 // Store-wide sequence number, 0 for version 1 records
 	Key   string
 	Value []byte
+
+	// Unix time in nanoseconds after which the value is gone, 0 for never
+	ExpiresAt int64
+
+	// Codec Value is compressed with, and its length once decompressed
+	Codec   Compression
+	RawSize uint32
+
+	// Encryption key and nonce Key and Value are sealed with; KeyID 0 means
+	// the record is not encrypted. Value then ends with the GCM tag.
+	KeyID uint32
+	Nonce []byte
+
+	// Large marks a set whose value lives in a large object file; Value
+	// then describes the object rather than holding it
+	Large bool
+
+	diskSize uint32 // Bytes the record occupied when it was read
 }
 
-// WriteRecord writes a record to a writer
+// Version 1: magic + opcode + key length + value length
+const recordHeaderSizeV1 = 2 + 1 + 4 + 4
+
+// Version 2: magic + opcode + flags + sequence + key length + value length
+const recordHeaderSize = 2 + 1 + 1 + 8 + 4 + 4
+
+// Longest key and value a record may hold. The checksum that would catch a
+// damaged length comes after the data it describes, so ReadRecord refuses
+// lengths beyond these before allocating for them.
+const (
+	maxKeySize   = 64 * 1024
+	maxValueSize = 1024 * 1024 * 1024
+)
+
+// WriteRecord writes a record to a writer in the version 2 format
 func WriteRecord(w io.Writer, rec *Record) error {
-	// Write magic
-	if _, err := w.Write(Magic[:]); err != nil {
-		return err
+	if len(rec.Key) > maxKeySize {
+		return ErrKeyTooLarge
 	}
-
-	// Write opcode
-	if _, err := w.Write([]byte{rec.Op}); err != nil {
-		return err
+	if storesValue(rec) && len(rec.Value) > maxValueSize {
+		return ErrValueTooLarge
+	}
+	value := rec.Value
+	if !storesValue(rec) {
+		value = nil
 	}
 
-	// Write key length and key
-	keyBytes := []byte(rec.Key)
-	keyLen := uint32(len(keyBytes))
-	if err := binary.Write(w, binary.LittleEndian, keyLen); err != nil {
-		return err
+	header := make([]byte, recordHeaderSize, recordHeaderSize+8+5+16)
+	copy(header, MagicV2[:])
+	header[2] = rec.Op
+	binary.LittleEndian.PutUint64(header[4:12], rec.Seq)
+	binary.LittleEndian.PutUint32(header[12:16], uint32(len(rec.Key)))
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(value)))
+	if rec.ExpiresAt != 0 {
+		header[3] |= flagExpires
+		header = binary.LittleEndian.AppendUint64(header, uint64(rec.ExpiresAt))
+	}
+	if rec.Codec != CompressionNone {
+		header[3] |= flagCompressed
+		header = append(header, byte(rec.Codec))
+		header = binary.LittleEndian.AppendUint32(header, rec.RawSize)
+	}
+	if rec.KeyID != 0 {
+		if len(rec.Nonce) != nonceSize {
+			return fmt.Errorf("encrypted record needs a %d-byte nonce", nonceSize)
+		}
+		header[3] |= flagEncrypted
+		header = binary.LittleEndian.AppendUint32(header, rec.KeyID)
+		header = append(header, rec.Nonce...)
+	}
+	if rec.Large {
+		header[3] |= flagLarge
 	}
 
-	// Write value length
-	valLen := uint32(len(rec.Value))
-	if err := binary.Write(w, binary.LittleEndian, valLen); err != nil {
+	h := crc32.NewIEEE()
+	_, _ = h.Write(header[2:]) // Ignore error for hash.Write
+	_, _ = io.WriteString(h, rec.Key)
+	_, _ = h.Write(value)
+
+	if _, err := w.Write(header); err != nil {
 		return err
 	}
-
-	// Write key
-	if _, err := w.Write(keyBytes); err != nil {
+	if _, err := io.WriteString(w, rec.Key); err != nil {
 		return err
 	}
-
-	// Write value (only for SET)
-	if rec.Op == OpSet && len(rec.Value) > 0 {
-		if _, err := w.Write(rec.Value); err != nil {
+	if len(value) > 0 {
+		if _, err := w.Write(value); err != nil {
 			return err
 		}
 	}
 
-	// Compute and write checksum
-	checksum := computeChecksum(rec)
-	if err := binary.Write(w, binary.LittleEndian, checksum); err != nil {
-		return err
-	}
-
-	return nil
+	return binary.Write(w, binary.LittleEndian, h.Sum32())
 }
 
-// ReadRecord reads a record from a reader
+// ReadRecord reads a record in either format from a reader. It returns
+// io.EOF only when the reader is exhausted at a record boundary; a record
+// cut short anywhere else yields io.ErrUnexpectedEOF. A record that fails
+// its checksum is returned as read along with ErrChecksumMismatch, for
+// tools that inspect damage.
 func ReadRecord(r io.Reader) (*Record, error) {
 	// Read magic
 	var magic [2]byte
@@ -79,48 +160,123 @@ func ReadRecord(r io.Reader) (*Record, error) {
 		return nil, err
 	}
 
-	if magic != Magic {
+	switch magic {
+	case MagicV2:
+		return readRecordV2(r)
+	case Magic:
+		return readRecordV1(r)
+	default:
 		return nil, ErrInvalidMagic
 	}
+}
+
+func readRecordV2(r io.Reader) (*Record, error) {
+	header := make([]byte, recordHeaderSize)
+	copy(header, MagicV2[:])
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	op, flags := header[2], header[3]
+	if flags&^knownFlags != 0 {
+		return nil, ErrCorrupted
+	}
+	seq := binary.LittleEndian.Uint64(header[4:12])
+	keyLen := binary.LittleEndian.Uint32(header[12:16])
+	valLen := binary.LittleEndian.Uint32(header[16:20])
+
+	// Optional fields, then key, value and checksum
+	extra := optionalFieldsSize(flags)
+	if err := checkLengths(r, keyLen, valLen, uint64(extra)+4); err != nil {
+		return nil, err
+	}
+	body := make([]byte, uint64(extra)+uint64(keyLen)+uint64(valLen)+4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	h := crc32.NewIEEE()
+	_, _ = h.Write(header[2:])
+	_, _ = h.Write(body[:len(body)-4])
+	checksumOK := h.Sum32() == binary.LittleEndian.Uint32(body[len(body)-4:])
+
+	rec := &Record{
+		Op:       op,
+		Seq:      seq,
+		Large:    flags&flagLarge != 0,
+		diskSize: uint32(recordHeaderSize + len(body)),
+	}
+	fields := body[:extra]
+	if flags&flagExpires != 0 {
+		rec.ExpiresAt = int64(binary.LittleEndian.Uint64(fields))
+		fields = fields[8:]
+	}
+	if flags&flagCompressed != 0 {
+		rec.Codec = Compression(fields[0])
+		rec.RawSize = binary.LittleEndian.Uint32(fields[1:5])
+		fields = fields[5:]
+	}
+	if flags&flagEncrypted != 0 {
+		rec.KeyID = binary.LittleEndian.Uint32(fields)
+		rec.Nonce = fields[4 : 4+nonceSize]
+	}
+	body = body[extra:]
+	rec.Key = string(body[:keyLen])
+	if valLen > 0 {
+		rec.Value = body[keyLen : keyLen+valLen]
+	}
 
+	if !checksumOK {
+		return rec, ErrChecksumMismatch
+	}
+	return rec, nil
+}
+
+func readRecordV1(r io.Reader) (*Record, error) {
 	// Read opcode
 	var op [1]byte
 	if _, err := io.ReadFull(r, op[:]); err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
 
 	// Read key length
 	var keyLen uint32
 	if err := binary.Read(r, binary.LittleEndian, &keyLen); err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
 
 	// Read value length
 	var valLen uint32
 	if err := binary.Read(r, binary.LittleEndian, &valLen); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if !hasValue(op[0]) {
+		valLen = 0
+	}
+	if err := checkLengths(r, keyLen, valLen, 4); err != nil {
 		return nil, err
 	}
 
 	// Read key
 	keyBytes := make([]byte, keyLen)
 	if _, err := io.ReadFull(r, keyBytes); err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
 	key := string(keyBytes)
 
-	// Read value (only for SET)
+	// Read value (not for DELETE)
 	var value []byte
-	if op[0] == OpSet && valLen > 0 {
+	if hasValue(op[0]) && valLen > 0 {
 		value = make([]byte, valLen)
 		if _, err := io.ReadFull(r, value); err != nil {
-			return nil, err
+			return nil, unexpectedEOF(err)
 		}
 	}
 
 	// Read and verify checksum
 	var checksumStored uint32
 	if err := binary.Read(r, binary.LittleEndian, &checksumStored); err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
 
 	rec := &Record{
@@ -129,16 +285,145 @@ func ReadRecord(r io.Reader) (*Record, error) {
 		Value: value,
 	}
 
-	checksumCalc := computeChecksum(rec)
+	rec.diskSize = uint32(recordHeaderSizeV1+len(key)+len(value)) + 4
+
+	checksumCalc := computeChecksumV1(rec)
 	if checksumCalc != checksumStored {
-		return nil, ErrChecksumMismatch
+		return rec, ErrChecksumMismatch
 	}
 
 	return rec, nil
 }
 
-// computeChecksum calculates CRC32 for a record
-func computeChecksum(rec *Record) uint32 {
+// checkLengths refuses the key and value lengths of a record header if they
+// exceed the limits, or if the record, with extra more bytes besides, would
+// run past the end of r when r knows how much it has left
+func checkLengths(r io.Reader, keyLen, valLen uint32, extra uint64) error {
+	if keyLen > maxKeySize || valLen > maxValueSize {
+		return fmt.Errorf("%w: record claims %d key and %d value bytes", ErrCorrupted, keyLen, valLen)
+	}
+	if left, ok := r.(interface{ Len() int }); ok && uint64(keyLen)+uint64(valLen)+extra > uint64(left.Len()) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// sizedReader reads up to a known number of bytes, which it reports to
+// checkLengths, so records can be scanned from a file without a damaged
+// length driving a huge allocation
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+// newSizedReader returns a buffered reader over file from its current
+// position to its end, or over the next limit bytes if limit is not
+// negative
+func newSizedReader(file *os.File, limit int64) (*sizedReader, error) {
+	pos, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	left := info.Size() - pos
+	if limit >= 0 && limit < left {
+		left = limit
+	}
+	return &sizedReader{r: bufio.NewReader(file), left: left}, nil
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes left to read
+func (s *sizedReader) Len() int {
+	if s.left > math.MaxInt {
+		return math.MaxInt
+	}
+	return int(s.left)
+}
+
+// unexpectedEOF reports io.EOF inside a record as io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// optionalFieldsSize returns the size of the optional fields that follow a
+// version 2 header with the given flags
+func optionalFieldsSize(flags byte) int {
+	size := 0
+	if flags&flagExpires != 0 {
+		size += 8
+	}
+	if flags&flagCompressed != 0 {
+		size += 5
+	}
+	if flags&flagEncrypted != 0 {
+		size += 4 + nonceSize
+	}
+	return size
+}
+
+// recordSize returns the number of bytes WriteRecord emits for rec
+func recordSize(rec *Record) uint32 {
+	size := recordHeaderSize + len(rec.Key) + 4
+	if storesValue(rec) {
+		size += len(rec.Value)
+	}
+	if rec.ExpiresAt != 0 {
+		size += 8
+	}
+	if rec.Codec != CompressionNone {
+		size += 5
+	}
+	if rec.KeyID != 0 {
+		size += 4 + nonceSize
+	}
+	return uint32(size)
+}
+
+// expired reports whether a record with the given expiry is gone at now
+func expired(expiresAt int64, now time.Time) bool {
+	return expiresAt != 0 && expiresAt <= now.UnixNano()
+}
+
+// storedSize returns the number of bytes rec occupies on disk: what it was
+// read from if it came from ReadRecord, otherwise what WriteRecord emits
+func storedSize(rec *Record) uint32 {
+	if rec.diskSize != 0 {
+		return rec.diskSize
+	}
+	return recordSize(rec)
+}
+
+// hasValue reports whether records with the given opcode carry a value
+func hasValue(op byte) bool {
+	return op != OpDelete
+}
+
+// storesValue reports whether WriteRecord writes rec's value field. An
+// encrypted tombstone still needs it for the authentication tag.
+func storesValue(rec *Record) bool {
+	return hasValue(rec.Op) || rec.KeyID != 0
+}
+
+// computeChecksumV1 calculates CRC32 for a version 1 record
+func computeChecksumV1(rec *Record) uint32 {
 	h := crc32.NewIEEE()
 
 	_, _ = h.Write([]byte{rec.Op}) // Ignore error for hash.Write
@@ -152,7 +437,7 @@ func computeChecksum(rec *Record) uint32 {
 
 	_, _ = h.Write(keyBytes)
 
-	if rec.Op == OpSet && len(rec.Value) > 0 {
+	if hasValue(rec.Op) && len(rec.Value) > 0 {
 		_, _ = h.Write(rec.Value)
 	}
 
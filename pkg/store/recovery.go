@@ -0,0 +1,101 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// isTornWrite reports whether a replay error looks like a record that was
+// only partially written
+func isTornWrite(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, ErrChecksumMismatch) ||
+		errors.Is(err, ErrInvalidMagic) ||
+		errors.Is(err, errIncompleteBatch)
+}
+
+// truncateTornTail cuts a segment back to validSize when everything past it
+// is the remains of an interrupted write. Intact records between validSize
+// and damageAt belong to an unfinished batch and are discarded with it. If an
+// intact record still follows the damage, the corruption is not a torn tail
+// and nothing is changed.
+func truncateTornTail(path string, validSize, damageAt uint64) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if uint64(len(data)) < damageAt || damageAt < validSize {
+		return 0, fmt.Errorf("segment shorter than replayed offset %d", damageAt)
+	}
+
+	tail := data[validSize:]
+	if damageAt < uint64(len(data)) {
+		if pos := findIntactRecord(data[damageAt+1:]); pos >= 0 {
+			return 0, fmt.Errorf("intact record at offset %d after damage: %w",
+				damageAt+1+uint64(pos), ErrCorrupted)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(int64(validSize)); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+
+	return int64(len(tail)), nil
+}
+
+// findIntactRecord returns the position of the first record in data that
+// decodes with a valid checksum, or -1 if there is none
+func findIntactRecord(data []byte) int {
+	for pos := 0; pos < len(data); {
+		i := indexMagic(data[pos:])
+		if i < 0 {
+			return -1
+		}
+		pos += i
+		if fitsRecord(data[pos:]) {
+			if _, err := ReadRecord(bytes.NewReader(data[pos:])); err == nil {
+				return pos
+			}
+		}
+		pos++
+	}
+	return -1
+}
+
+// indexMagic returns the position of the first record magic of either
+// version in data, or -1 if there is none
+func indexMagic(data []byte) int {
+	i := bytes.Index(data, Magic[:])
+	if j := bytes.Index(data, MagicV2[:]); j >= 0 && (i < 0 || j < i) {
+		i = j
+	}
+	return i
+}
+
+// fitsRecord reports whether the lengths in a candidate record header fit
+// inside data, so garbage lengths never drive a huge allocation
+func fitsRecord(data []byte) bool {
+	headerSize, lengths := recordHeaderSizeV1, 3
+	if len(data) >= recordHeaderSize && data[1] == MagicV2[1] {
+		headerSize, lengths = recordHeaderSize+optionalFieldsSize(data[3]), 12
+	}
+	if len(data) < headerSize {
+		return false
+	}
+	keyLen := uint64(binary.LittleEndian.Uint32(data[lengths : lengths+4]))
+	valLen := uint64(binary.LittleEndian.Uint32(data[lengths+4 : lengths+8]))
+	return uint64(headerSize)+keyLen+valLen+4 <= uint64(len(data))
+}
@@ -0,0 +1,105 @@
+package store
+
+import "math/rand"
+
+const (
+	skipListMaxLevel = 24
+	skipListP        = 0.25
+)
+
+// skipNode is one key in a skipList
+type skipNode struct {
+	key   string
+	entry *IndexEntry
+	next  []*skipNode
+}
+
+// skipList keeps index entries sorted by key. It is not safe for
+// concurrent use; Index guards it.
+type skipList struct {
+	head  *skipNode
+	level int
+	len   int
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+// findGE returns the first node whose key is >= key, or nil. If prev is
+// non-nil it receives the last node before that position on every level.
+func (l *skipList) findGE(key string, prev []*skipNode) *skipNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// get returns the entry stored under key
+func (l *skipList) get(key string) (*IndexEntry, bool) {
+	n := l.findGE(key, nil)
+	if n == nil || n.key != key {
+		return nil, false
+	}
+	return n.entry, true
+}
+
+// set inserts key or replaces its entry
+func (l *skipList) set(key string, entry *IndexEntry) {
+	prev := make([]*skipNode, skipListMaxLevel)
+	if n := l.findGE(key, prev); n != nil && n.key == key {
+		n.entry = entry
+		return
+	}
+
+	level := randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			prev[i] = l.head
+		}
+		l.level = level
+	}
+
+	n := &skipNode{key: key, entry: entry, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	l.len++
+}
+
+// remove deletes key, reporting whether it was present
+func (l *skipList) remove(key string) bool {
+	prev := make([]*skipNode, skipListMaxLevel)
+	n := l.findGE(key, prev)
+	if n == nil || n.key != key {
+		return false
+	}
+
+	for i := 0; i < len(n.next); i++ {
+		prev[i].next[i] = n.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.len--
+	return true
+}
+
+// randomLevel picks the height of a new node
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
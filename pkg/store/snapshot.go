@@ -2,85 +2,237 @@ package store
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 )
 
-var snapshotMagic = [8]byte{'K', 'V', 'I', 'N', 'D', 'E', 'X', '1'}
+var (
+	snapshotMagicV1 = [8]byte{'K', 'V', 'I', 'N', 'D', 'E', 'X', '1'}
+	snapshotMagic   = [8]byte{'K', 'V', 'I', 'N', 'D', 'E', 'X', '2'}
+)
+
+// indexSnapshot is the store state a snapshot restores. A snapshot taken by
+// a store covers every record before offset in segment; segment 0 means it
+// covers nothing and every segment has to be replayed.
+type indexSnapshot struct {
+	index    *Index
+	seq      uint64
+	segment  uint64
+	offset   uint64
+	segments []SegmentStats // Counters of the segments it covers
+}
 
-// SaveSnapshot writes the index to disk for fast restarts
+// SaveSnapshot writes the index to disk for fast restarts. The file is
+// replaced atomically, so a crash leaves either the old or the new one.
 func SaveSnapshot(idx *Index, path string) error {
-	file, err := os.Create(path)
+	return writeSnapshotFile(path, &indexSnapshot{index: idx}, nil)
+}
+
+// LoadSnapshot reads the index from disk
+func LoadSnapshot(path string) (*Index, error) {
+	snap, err := readSnapshotFile(path, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
+	return snap.index, nil
+}
 
-	w := bufio.NewWriter(file)
-	defer func() {
-		_ = w.Flush() // ensure flush error ignored
-	}()
+// snapshot captures the store's current state; callers hold s.mu
+func (s *KVStore) snapshot() *indexSnapshot {
+	segments := make([]SegmentStats, 0, len(s.segStats))
+	for _, st := range s.segStats {
+		segments = append(segments, *st)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].ID < segments[j].ID })
 
-	// Write magic
-	if _, err := w.Write(snapshotMagic[:]); err != nil {
-		return err
+	return &indexSnapshot{
+		index:    s.index,
+		seq:      s.seq,
+		segment:  s.activeSegmentID,
+		offset:   s.activeOffset,
+		segments: segments,
 	}
+}
 
-	// Get all keys
-	keys := idx.Keys()
-	numEntries := uint64(len(keys))
+// covers reports whether the snapshot still describes the segments on disk
+// up to its position, so replay can resume from there. Compaction since the
+// snapshot was taken, or a segment that lost data it covers, rules that out.
+func (snap *indexSnapshot) covers(dir string, segments []uint64) bool {
+	if snap.segment == 0 {
+		return false
+	}
 
-	// Write number of entries
-	if err := binary.Write(w, binary.LittleEndian, numEntries); err != nil {
-		return err
+	onDisk := make(map[uint64]bool, len(segments))
+	for _, segID := range segments {
+		onDisk[segID] = true
+	}
+	for _, st := range snap.segments {
+		if !onDisk[st.ID] {
+			return false
+		}
 	}
 
-	// Write each entry
-	for _, key := range keys {
-		entry, ok := idx.Get(key)
-		if !ok {
-			continue
+	if snap.offset > 0 {
+		info, err := os.Stat(segmentPath(dir, snap.segment))
+		if err != nil || uint64(info.Size()) < snap.offset {
+			return false
 		}
+	}
+	return true
+}
+
+// writeSnapshotFile encodes a snapshot, sealing it with keys when the store
+// is encrypted, and installs it at path
+func writeSnapshotFile(path string, snap *indexSnapshot, keys *Keyring) error {
+	data, err := keys.sealFile(encodeSnapshot(snap))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// readSnapshotFile reads a snapshot written by writeSnapshotFile, or an
+// index in the original format
+func readSnapshotFile(path string, keys *Keyring) (*indexSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = keys.openFile(data); err != nil {
+		return nil, err
+	}
 
-		// Write key length and key
-		keyBytes := []byte(key)
-		keyLen := uint32(len(keyBytes))
-		if err := binary.Write(w, binary.LittleEndian, keyLen); err != nil {
-			return err
+	if bytes.HasPrefix(data, snapshotMagicV1[:]) {
+		idx, err := readSnapshotV1(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, err
 		}
-		if _, err := w.Write(keyBytes); err != nil {
-			return err
+		return &indexSnapshot{index: idx}, nil
+	}
+	return decodeSnapshot(data)
+}
+
+// encodeSnapshot lays a snapshot out as magic, header, index entries and
+// segment counters, followed by a CRC32 of everything before it
+func encodeSnapshot(snap *indexSnapshot) []byte {
+	le := binary.LittleEndian
+
+	buf := append([]byte(nil), snapshotMagic[:]...)
+	buf = le.AppendUint64(buf, snap.seq)
+	buf = le.AppendUint64(buf, snap.segment)
+	buf = le.AppendUint64(buf, snap.offset)
+	buf = le.AppendUint64(buf, uint64(snap.index.Len()))
+
+	snap.index.Range(func(key string, entry *IndexEntry) bool {
+		buf = le.AppendUint32(buf, uint32(len(key)))
+		buf = append(buf, key...)
+		buf = le.AppendUint64(buf, entry.SegmentID)
+		buf = le.AppendUint64(buf, entry.Offset)
+		buf = le.AppendUint32(buf, entry.Size)
+		buf = le.AppendUint32(buf, entry.ValueSize)
+		buf = le.AppendUint32(buf, entry.StoredSize)
+		buf = le.AppendUint64(buf, entry.Version)
+		buf = le.AppendUint64(buf, uint64(entry.ExpiresAt))
+		return true
+	})
+
+	buf = le.AppendUint32(buf, uint32(len(snap.segments)))
+	for _, st := range snap.segments {
+		buf = le.AppendUint64(buf, st.ID)
+		buf = le.AppendUint64(buf, st.LiveBytes)
+		buf = le.AppendUint64(buf, st.DeadBytes)
+	}
+
+	return le.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeSnapshot parses a snapshot written by encodeSnapshot, rejecting it
+// whole if it is truncated or damaged
+func decodeSnapshot(data []byte) (*indexSnapshot, error) {
+	if len(data) < len(snapshotMagic)+4 {
+		return nil, ErrCorrupted
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if !bytes.HasPrefix(body, snapshotMagic[:]) {
+		return nil, ErrInvalidMagic
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, ErrChecksumMismatch
+	}
+
+	r := bytes.NewReader(body[len(snapshotMagic):])
+	read := func(v interface{}) error {
+		return unexpectedEOF(binary.Read(r, binary.LittleEndian, v))
+	}
+
+	snap := &indexSnapshot{index: NewIndex()}
+	var numEntries uint64
+	for _, v := range []interface{}{&snap.seq, &snap.segment, &snap.offset, &numEntries} {
+		if err := read(v); err != nil {
+			return nil, err
 		}
+	}
 
-		// Write segment ID and offset
-		if err := binary.Write(w, binary.LittleEndian, entry.SegmentID); err != nil {
-			return err
+	for i := uint64(0); i < numEntries; i++ {
+		var keyLen uint32
+		if err := read(&keyLen); err != nil {
+			return nil, err
 		}
-		if err := binary.Write(w, binary.LittleEndian, entry.Offset); err != nil {
-			return err
+		if int64(keyLen) > int64(r.Len()) {
+			return nil, fmt.Errorf("%w: entry %d key length %d", ErrCorrupted, i, keyLen)
+		}
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, unexpectedEOF(err)
 		}
-	}
 
-	return nil
-}
+		entry := &IndexEntry{}
+		for _, v := range []interface{}{
+			&entry.SegmentID, &entry.Offset, &entry.Size, &entry.ValueSize,
+			&entry.StoredSize, &entry.Version, &entry.ExpiresAt,
+		} {
+			if err := read(v); err != nil {
+				return nil, err
+			}
+		}
+		snap.index.Insert(string(key), entry)
+	}
 
-// LoadSnapshot reads the index from disk
-func LoadSnapshot(path string) (*Index, error) {
-	file, err := os.Open(path)
-	if err != nil {
+	var numSegments uint32
+	if err := read(&numSegments); err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	for i := uint32(0); i < numSegments; i++ {
+		var st SegmentStats
+		for _, v := range []interface{}{&st.ID, &st.LiveBytes, &st.DeadBytes} {
+			if err := read(v); err != nil {
+				return nil, err
+			}
+		}
+		snap.segments = append(snap.segments, st)
+	}
 
-	r := bufio.NewReader(file)
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes in snapshot", ErrCorrupted, r.Len())
+	}
+	return snap, nil
+}
 
+// readSnapshotV1 reads a snapshot in the original format, which holds
+// only key locations and has no checksum
+func readSnapshotV1(r io.Reader) (*Index, error) {
 	// Read and verify magic
 	var magic [8]byte
 	if _, err := io.ReadFull(r, magic[:]); err != nil {
 		return nil, err
 	}
-	if magic != snapshotMagic {
+	if magic != snapshotMagicV1 {
 		return nil, ErrInvalidMagic
 	}
 
@@ -115,8 +267,38 @@ func LoadSnapshot(path string) (*Index, error) {
 			return nil, err
 		}
 
-		idx.Insert(key, segmentID, offset)
+		idx.Insert(key, &IndexEntry{
+			SegmentID: segmentID,
+			Offset:    offset,
+		})
 	}
 
 	return idx, nil
 }
+
+// writeFileAtomic replaces path with data: it writes a temporary file,
+// fsyncs it, renames it over path and fsyncs the directory
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotEncoding(t *testing.T) {
+	idx := NewIndex()
+	idx.Insert("a", &IndexEntry{SegmentID: 1, Offset: 0, Size: 30, ValueSize: 5, StoredSize: 5, Version: 1})
+	idx.Insert("b", &IndexEntry{SegmentID: 2, Offset: 60, Size: 40, ValueSize: 9, StoredSize: 4, Version: 7, ExpiresAt: 12345})
+	snap := &indexSnapshot{
+		index:    idx,
+		seq:      7,
+		segment:  2,
+		offset:   100,
+		segments: []SegmentStats{{ID: 1, LiveBytes: 30, DeadBytes: 30}, {ID: 2, LiveBytes: 40, DeadBytes: 60}},
+	}
+
+	data := encodeSnapshot(snap)
+	got, err := decodeSnapshot(data)
+	require.NoError(t, err)
+	assert.Equal(t, snap.seq, got.seq)
+	assert.Equal(t, snap.segment, got.segment)
+	assert.Equal(t, snap.offset, got.offset)
+	assert.Equal(t, snap.segments, got.segments)
+	for _, key := range []string{"a", "b"} {
+		want, _ := idx.Get(key)
+		entry, ok := got.index.Get(key)
+		require.True(t, ok)
+		assert.Equal(t, want, entry)
+	}
+
+	// Damage anywhere, including a cut-off tail, rejects the whole file
+	for i := range data {
+		damaged := append([]byte(nil), data...)
+		damaged[i] ^= 0x01
+		_, err := decodeSnapshot(damaged)
+		assert.Error(t, err, "byte %d", i)
+	}
+	for n := 0; n < len(data); n++ {
+		_, err := decodeSnapshot(data[:n])
+		assert.Error(t, err, "length %d", n)
+	}
+}
+
+func TestLoadSnapshotV1(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	buf.Write(snapshotMagicV1[:])
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(1)))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint32(3)))
+	buf.WriteString("key")
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(4)))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(128)))
+	path := filepath.Join(dir, snapshotFile)
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+
+	idx, err := LoadSnapshot(path)
+	require.NoError(t, err)
+	entry, ok := idx.Get("key")
+	require.True(t, ok)
+	assert.Equal(t, &IndexEntry{SegmentID: 4, Offset: 128}, entry)
+}
+
+// replayedSegments opens dir and returns the segments it replayed
+func replayedSegments(t *testing.T, dir string, opts ...Option) (*KVStore, []uint64) {
+	t.Helper()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	store, err := OpenWithOptions(dir, append(opts, WithLogger(logger))...)
+	require.NoError(t, err)
+
+	var replayed []uint64
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var line struct {
+			Msg     string `json:"msg"`
+			Segment uint64 `json:"segment"`
+		}
+		require.NoError(t, dec.Decode(&line))
+		if line.Msg == "replayed segment" {
+			replayed = append(replayed, line.Segment)
+		}
+	}
+	return store, replayed
+}
+
+func TestSnapshotSkipsCoveredSegments(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	defer os.RemoveAll(dir)
+
+	store, err := OpenWithOptions(dir, WithSegmentSize(256))
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%02d", i), bytes.Repeat([]byte("v"), 40)))
+	}
+	require.NoError(t, store.Delete("key00"))
+	require.NoError(t, store.SaveSnapshot())
+	covered := store.activeSegmentID
+
+	// Written after the snapshot, partly into the segment it stopped in
+	for i := 20; i < 30; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%02d", i), bytes.Repeat([]byte("v"), 40)))
+	}
+	require.NoError(t, store.Delete("key01"))
+	wantStats := store.Stats()
+	require.NoError(t, store.Close())
+
+	store, replayed := replayedSegments(t, dir, WithSegmentSize(256))
+	defer store.Close()
+
+	require.NotEmpty(t, replayed)
+	for _, segID := range replayed {
+		assert.GreaterOrEqual(t, segID, covered)
+	}
+
+	for i := 0; i < 30; i++ {
+		got, err := store.Get(fmt.Sprintf("key%02d", i))
+		if i < 2 {
+			assert.ErrorIs(t, err, ErrNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Len(t, got, 40)
+	}
+	_, version, err := store.GetWithVersion("key29")
+	require.NoError(t, err)
+	assert.Equal(t, store.seq-1, version)
+
+	gotStats := store.Stats()
+	assert.Equal(t, wantStats.NumKeys, gotStats.NumKeys)
+	for i, seg := range wantStats.Segments[:len(wantStats.Segments)-1] {
+		assert.Equal(t, seg, gotStats.Segments[i])
+	}
+}
+
+func TestOutdatedSnapshotIsIgnored(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+	defer os.RemoveAll(dir)
+
+	store, err := OpenWithOptions(dir, WithSegmentSize(128))
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), bytes.Repeat([]byte("v"), 40)))
+	}
+	require.NoError(t, store.SaveSnapshot())
+	path := filepath.Join(dir, snapshotFile)
+	old, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// Compaction removes segments the old snapshot points into
+	require.NoError(t, store.Delete("key3"))
+	require.NoError(t, store.Compact())
+	require.NoError(t, store.Close())
+	require.NoError(t, os.WriteFile(path, old, 0644))
+	segments, err := findSegments(dir)
+	require.NoError(t, err)
+
+	store, replayed := replayedSegments(t, dir, WithSegmentSize(128))
+	defer store.Close()
+
+	assert.Equal(t, segments, replayed)
+	_, err = store.Get("key3")
+	assert.ErrorIs(t, err, ErrNotFound)
+	got, err := store.Get("key9")
+	require.NoError(t, err)
+	assert.Len(t, got, 40)
+}
+
+func TestTruncatedSnapshotIsIgnored(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("v")))
+	}
+	require.NoError(t, store.SaveSnapshot())
+	require.NoError(t, store.Close())
+
+	path := filepath.Join(dir, snapshotFile)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()/2))
+
+	store, err = Open(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Len(t, store.ListKeys(), 10)
+}
@@ -4,11 +4,44 @@ import "fmt"
 
 // StoreStats contains statistics about the store
 type StoreStats struct {
-	NumKeys          int
-	NumSegments      int
-	TotalBytes       uint64
-	ActiveSegmentID  int
-	OldestSegmentID  int
+	NumKeys         int
+	NumSegments     int
+	TotalBytes      uint64 // Value bytes of live keys
+	StoredBytes     uint64 // The same values as stored, after compression
+	ActiveSegmentID int
+	OldestSegmentID int
+	Segments        []SegmentStats
+}
+
+// SegmentStats describes how many bytes of a segment are still referenced
+type SegmentStats struct {
+	ID        uint64
+	LiveBytes uint64
+	DeadBytes uint64
+}
+
+// GarbageRatio returns the fraction of the segment that is dead
+func (s SegmentStats) GarbageRatio() float64 {
+	total := s.LiveBytes + s.DeadBytes
+	if total == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes) / float64(total)
+}
+
+// String returns a one-line summary of the segment
+func (s SegmentStats) String() string {
+	return fmt.Sprintf("segment %d: live %d B, dead %d B (%.0f%% garbage)",
+		s.ID, s.LiveBytes, s.DeadBytes, s.GarbageRatio()*100)
+}
+
+// CompressionRatio returns how many times smaller live values are on disk
+// than in memory; 1 means no saving
+func (s StoreStats) CompressionRatio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.TotalBytes) / float64(s.StoredBytes)
 }
 
 // TotalMB returns total size in megabytes
@@ -23,17 +56,23 @@ func (s StoreStats) TotalKB() float64 {
 
 // String returns a formatted string representation
 func (s StoreStats) String() string {
-	return fmt.Sprintf(
+	out := fmt.Sprintf(
 		"Store Statistics:\n"+
 			"  Keys: %d\n"+
 			"  Segments: %d\n"+
 			"  Total size: %.2f MB\n"+
+			"  Compression ratio: %.2fx\n"+
 			"  Active segment: %d\n"+
 			"  Oldest segment: %d",
 		s.NumKeys,
 		s.NumSegments,
 		s.TotalMB(),
+		s.CompressionRatio(),
 		s.ActiveSegmentID,
 		s.OldestSegmentID,
 	)
+	for _, seg := range s.Segments {
+		out += "\n    " + seg.String()
+	}
+	return out
 }
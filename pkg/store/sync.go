@@ -0,0 +1,166 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncMode selects when writes are fsynced to disk
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs before acknowledging a write. Concurrent writers
+	// share a single fsync (group commit).
+	SyncAlways SyncMode = iota
+	// SyncInterval fsyncs in the background every SyncPolicy.Interval, so a
+	// crash can lose the writes of the last interval
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+// String returns the name used by ParseSyncPolicy
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+}
+
+// SyncPolicy controls write durability
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration // Only used by SyncInterval
+}
+
+// ParseSyncPolicy builds a policy from a mode name ("always", "interval"
+// or "never") and the interval used by the interval mode
+func ParseSyncPolicy(mode string, interval time.Duration) (SyncPolicy, error) {
+	switch mode {
+	case "always", "":
+		return SyncPolicy{Mode: SyncAlways}, nil
+	case "interval":
+		if interval <= 0 {
+			return SyncPolicy{}, fmt.Errorf("sync interval must be positive, got %v", interval)
+		}
+		return SyncPolicy{Mode: SyncInterval, Interval: interval}, nil
+	case "never":
+		return SyncPolicy{Mode: SyncNever}, nil
+	default:
+		return SyncPolicy{}, fmt.Errorf("unknown sync mode %q", mode)
+	}
+}
+
+// groupCommit lets one writer fsync on behalf of every writer that is
+// waiting at the same time
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool
+	synced  uint64 // Highest write ticket known to be durable
+}
+
+func newGroupCommit() *groupCommit {
+	gc := &groupCommit{}
+	gc.cond = sync.NewCond(&gc.mu)
+	return gc
+}
+
+// advance records that every write up to ticket is durable
+func (gc *groupCommit) advance(ticket uint64) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if ticket > gc.synced {
+		gc.synced = ticket
+	}
+}
+
+// durable returns the highest write ticket known to be durable
+func (gc *groupCommit) durable() uint64 {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.synced
+}
+
+// waitDurable blocks until the write with the given ticket has been fsynced
+// when the policy requires it, then removes the large objects that writes
+// made durable so far retired
+func (s *KVStore) waitDurable(ticket uint64) error {
+	defer s.removeRetired()
+	if s.syncPolicy.Mode != SyncAlways {
+		return nil
+	}
+
+	gc := s.commits
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	for gc.synced < ticket {
+		if gc.syncing {
+			gc.cond.Wait()
+			continue
+		}
+
+		// Become the leader: one fsync covers every write flushed so far
+		gc.syncing = true
+		gc.mu.Unlock()
+		err := s.syncActive()
+		gc.mu.Lock()
+		gc.syncing = false
+		gc.cond.Broadcast()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncActive fsyncs the active segment and records every write it covers
+// as durable
+func (s *KVStore) syncActive() error {
+	s.mu.RLock()
+	file := s.activeFile
+	target := s.written
+	s.mu.RUnlock()
+
+	if file != nil {
+		err := file.Sync()
+		// A segment sealed in the meantime was fsynced as it was sealed
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	s.commits.advance(target)
+	return nil
+}
+
+// runIntervalSync fsyncs the active segment until stop is closed
+func (s *KVStore) runIntervalSync(interval time.Duration, stop <-chan struct{}) {
+	defer s.syncWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.syncActive(); err != nil {
+				s.logger.Warn("background sync failed", "err", err)
+			}
+			s.removeRetired()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSyncPolicy(t *testing.T) {
+	policy, err := ParseSyncPolicy("always", 0)
+	require.NoError(t, err)
+	assert.Equal(t, SyncAlways, policy.Mode)
+
+	policy, err = ParseSyncPolicy("interval", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, SyncPolicy{Mode: SyncInterval, Interval: 50 * time.Millisecond}, policy)
+
+	policy, err = ParseSyncPolicy("never", 0)
+	require.NoError(t, err)
+	assert.Equal(t, SyncNever, policy.Mode)
+
+	_, err = ParseSyncPolicy("interval", 0)
+	assert.Error(t, err)
+	_, err = ParseSyncPolicy("sometimes", 0)
+	assert.Error(t, err)
+}
+
+func TestSyncPolicies(t *testing.T) {
+	policies := []SyncPolicy{
+		{Mode: SyncAlways},
+		{Mode: SyncInterval, Interval: 5 * time.Millisecond},
+		{Mode: SyncNever},
+	}
+
+	for _, policy := range policies {
+		t.Run(policy.Mode.String(), func(t *testing.T) {
+			dir := filepath.Join("testdata", t.Name())
+			require.NoError(t, os.RemoveAll(dir))
+			defer os.RemoveAll(dir)
+
+			store, err := OpenWithOptions(dir, WithSyncPolicy(policy))
+			require.NoError(t, err)
+
+			// Concurrent writers share fsyncs but each must see its write land
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 25; i++ {
+						key := fmt.Sprintf("w%d-%d", w, i)
+						assert.NoError(t, store.Set(key, []byte(key)))
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			if policy.Mode == SyncAlways {
+				assert.Equal(t, store.written, store.commits.synced)
+			}
+			require.NoError(t, store.Close())
+
+			store, err = OpenWithOptions(dir, WithSyncPolicy(policy))
+			require.NoError(t, err)
+			defer store.Close()
+
+			assert.Len(t, store.ListKeys(), 200)
+			val, err := store.Get("w7-24")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("w7-24"), val)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package store
+
+import "time"
+
+// SetWithTTL stores a key-value pair that expires after ttl. Expired keys
+// are hidden from reads at once and dropped from disk by compaction.
+func (s *KVStore) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	s.mu.Lock()
+	ticket, err := s.set(key, value, s.now().Add(ttl).UnixNano())
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.waitDurable(ticket)
+}
+
+// TTL returns the remaining lifetime of a key, or 0 if it never expires
+func (s *KVStore) TTL(key string) (time.Duration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.lookup(key)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if entry.ExpiresAt == 0 {
+		return 0, nil
+	}
+
+	return time.Unix(0, entry.ExpiresAt).Sub(s.now()), nil
+}
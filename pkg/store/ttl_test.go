@@ -0,0 +1,101 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock lets tests move the store's notion of now
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestSetWithTTL(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	clock := &fakeClock{now: time.Now()}
+	store.now = clock.Now
+
+	assert.Equal(t, ErrInvalidTTL, store.SetWithTTL("bad", []byte("x"), 0))
+
+	require.NoError(t, store.SetWithTTL("session", []byte("abc"), time.Minute))
+	require.NoError(t, store.Set("forever", []byte("x")))
+
+	ttl, err := store.TTL("session")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl)
+	ttl, err = store.TTL("forever")
+	require.NoError(t, err)
+	assert.Zero(t, ttl)
+
+	clock.Advance(30 * time.Second)
+	ttl, err = store.TTL("session")
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, ttl)
+
+	// The expiry survives a restart
+	require.NoError(t, store.Close())
+	store, err = Open(dir)
+	require.NoError(t, err)
+	store.now = clock.Now
+	ttl, err = store.TTL("session")
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, ttl)
+
+	clock.Advance(30 * time.Second)
+	_, err = store.Get("session")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = store.TTL("session")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, []string{"forever"}, store.ListKeys())
+
+	// An expired key counts as absent for conditional writes
+	_, err = store.SetIfAbsent("session", []byte("new"))
+	require.NoError(t, err)
+	val, err := store.Get("session")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), val)
+}
+
+func TestCompactionDropsExpiredKeys(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	clock := &fakeClock{now: time.Now()}
+	store.now = clock.Now
+
+	// An older segment that stays out of the merge still holds a value
+	// for "shadowed"
+	require.NoError(t, store.Set("shadowed", []byte("old")))
+	require.NoError(t, store.rotateSegment())
+	olderID := store.activeSegmentID - 1
+
+	require.NoError(t, store.SetWithTTL("shadowed", []byte("new"), time.Second))
+	require.NoError(t, store.SetWithTTL("temp", []byte("x"), time.Second))
+	require.NoError(t, store.Set("keep", []byte("y")))
+	clock.Advance(time.Minute)
+
+	_, err := store.compact(func(st SegmentStats) bool { return st.ID != olderID })
+	require.NoError(t, err)
+
+	assert.False(t, store.index.Contains("temp"))
+	assert.False(t, store.index.Contains("shadowed"))
+	assert.Equal(t, []string{"keep"}, store.ListKeys())
+
+	// The expired value must not let the older one resurface on replay
+	require.NoError(t, store.Close())
+	store, err = Open(dir)
+	require.NoError(t, err)
+	store.now = clock.Now
+	_, err = store.Get("shadowed")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, []string{"keep"}, store.ListKeys())
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Snapshot is a read-only view of the store as of the moment it was taken.
+// Writes made afterwards are invisible to it, and the segment files it
+// reads from stay on disk until it is released.
+//
+// Taking a snapshot is cheap: instead of copying the index, the store
+// records the previous entry of every key it changes while the snapshot is
+// open. Release snapshots promptly; each open one costs memory in
+// proportion to the writes made since it was taken.
+type Snapshot struct {
+	store *KVStore
+	now   time.Time // Keys expire as of this moment
+
+	// Entries of keys changed since the snapshot was taken, as they were
+	// then; a nil entry means the key did not exist. Guarded by store.mu.
+	before *skipList
+
+	pinned   map[uint64]bool
+	released bool
+}
+
+// Snapshot returns a point-in-time view of the store. Call Release when
+// done with it.
+func (s *KVStore) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.newSnapshot()
+}
+
+// newSnapshot registers a snapshot of the store; callers hold s.mu for
+// writing
+func (s *KVStore) newSnapshot() *Snapshot {
+	snap := &Snapshot{
+		store:  s,
+		now:    s.now(),
+		before: newSkipList(),
+		pinned: make(map[uint64]bool),
+	}
+
+	// Pin every segment a current index entry can point into
+	for segID := range s.segStats {
+		snap.pin(segID)
+	}
+	s.snapshots[snap] = struct{}{}
+
+	return snap
+}
+
+// Get retrieves a value by key as of the snapshot
+func (snap *Snapshot) Get(key string) ([]byte, error) {
+	s := snap.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if snap.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	entry, ok := snap.lookup(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return s.readValue(key, entry)
+}
+
+// NewIterator returns an iterator over the snapshot positioned at the
+// first key in range
+func (snap *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	return newIterator(snap.store, snap, opts)
+}
+
+// Release unpins the snapshot's segments so compaction can delete them
+func (snap *Snapshot) Release() {
+	s := snap.store
+	s.mu.Lock()
+	if snap.released {
+		s.mu.Unlock()
+		return
+	}
+	snap.released = true
+	snap.before = nil
+	delete(s.snapshots, snap)
+	for segID := range snap.pinned {
+		if s.pins[segID]--; s.pins[segID] <= 0 {
+			delete(s.pins, segID)
+		}
+	}
+	snap.pinned = nil
+	s.mu.Unlock()
+
+	if err := s.removeObsolete(); err != nil {
+		s.logger.Warn("failed to remove compacted segments", "err", err)
+	}
+	s.removeRetired()
+}
+
+// releaseSnapshots releases every open snapshot
+func (s *KVStore) releaseSnapshots() {
+	s.mu.Lock()
+	snaps := make([]*Snapshot, 0, len(s.snapshots))
+	for snap := range s.snapshots {
+		snaps = append(snaps, snap)
+	}
+	s.mu.Unlock()
+
+	for _, snap := range snaps {
+		snap.Release()
+	}
+}
+
+// pin keeps a segment on disk for the snapshot; callers hold store.mu for
+// writing
+func (snap *Snapshot) pin(segID uint64) {
+	if !snap.pinned[segID] {
+		snap.pinned[segID] = true
+		snap.store.pins[segID]++
+	}
+}
+
+// lookup returns the entry key had when the snapshot was taken; callers
+// hold store.mu
+func (snap *Snapshot) lookup(key string) (*IndexEntry, bool) {
+	entry, changed := snap.before.get(key)
+	if !changed {
+		// The live filter speaks for keys that have not changed since
+		if !snap.store.bloom.MightContain(key) {
+			return nil, false
+		}
+		entry, _ = snap.store.index.Get(key)
+	}
+	if entry == nil || expired(entry.ExpiresAt, snap.now) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// seek returns the first key >= from and below upper ("" for none) that
+// was live when the snapshot was taken; callers hold store.mu
+func (snap *Snapshot) seek(from, upper string) (string, bool) {
+	inRange := func(key string) bool {
+		return upper == "" || key < upper
+	}
+
+	// Keys unchanged since the snapshot are read from the live index
+	var current string
+	var haveCurrent bool
+	snap.store.index.Ascend(from, func(key string, entry *IndexEntry) bool {
+		if !inRange(key) {
+			return false
+		}
+		if _, changed := snap.before.get(key); changed || expired(entry.ExpiresAt, snap.now) {
+			return true
+		}
+		current, haveCurrent = key, true
+		return false
+	})
+
+	// Keys changed since then are read from what the snapshot recorded
+	for n := snap.before.findGE(from, nil); n != nil && inRange(n.key); n = n.next[0] {
+		if haveCurrent && n.key >= current {
+			break
+		}
+		if n.entry != nil && !expired(n.entry.ExpiresAt, snap.now) {
+			return n.key, true
+		}
+	}
+
+	return current, haveCurrent
+}
+
+// preserve records the current entry of key in every open snapshot that
+// has not seen it change yet; callers hold s.mu for writing
+func (s *KVStore) preserve(key string) {
+	if len(s.snapshots) == 0 {
+		return
+	}
+
+	entry, _ := s.index.Get(key)
+	for snap := range s.snapshots {
+		if _, changed := snap.before.get(key); !changed {
+			snap.before.set(key, entry)
+			// Compaction may have moved the entry since the snapshot was
+			// taken
+			if entry != nil {
+				snap.pin(entry.SegmentID)
+			}
+		}
+	}
+}
+
+// removeObsolete deletes compacted segments in the order compaction retired
+// them, stopping at the first one a snapshot still pins. Keeping that order
+// means a crash only ever leaves the newest inputs of a compaction behind,
+// which replay correctly underneath its output.
+func (s *KVStore) removeObsolete() error {
+	s.removeMu.Lock()
+	defer s.removeMu.Unlock()
+
+	for {
+		s.mu.Lock()
+		if len(s.obsolete) == 0 || s.pins[s.obsolete[0]] > 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		segID := s.obsolete[0]
+		s.mu.Unlock()
+
+		s.closeReader(segID)
+		if err := os.Remove(segmentPath(s.baseDir, segID)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove segment %d: %w", segID, err)
+		}
+		if err := os.Remove(hintPath(s.baseDir, segID)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove hint %d: %w", segID, err)
+		}
+
+		s.mu.Lock()
+		s.obsolete = s.obsolete[1:]
+		s.mu.Unlock()
+		s.logger.Debug("removed compacted segment", "segment", segID)
+	}
+}
+
+// isObsolete reports whether a segment has been compacted away but not yet
+// deleted; callers hold s.mu
+func (s *KVStore) isObsolete(segID uint64) bool {
+	for _, id := range s.obsolete {
+		if id == segID {
+			return true
+		}
+	}
+	return false
+}
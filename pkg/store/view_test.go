@@ -0,0 +1,142 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer cleanupTestStore(t, store, dir)
+
+	require.NoError(t, store.Set("a", []byte("1")))
+	require.NoError(t, store.Set("b", []byte("2")))
+	require.NoError(t, store.Set("c", []byte("3")))
+
+	snap := store.Snapshot()
+	defer snap.Release()
+
+	require.NoError(t, store.Set("a", []byte("changed")))
+	require.NoError(t, store.Delete("b"))
+	require.NoError(t, store.Set("aa", []byte("new")))
+	b := NewBatch()
+	b.Set("c", []byte("batched"))
+	b.Set("d", []byte("batched"))
+	require.NoError(t, store.Write(b))
+
+	val, err := snap.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), val)
+	val, err = snap.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), val)
+	val, err = snap.Get("c")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("3"), val)
+	_, err = snap.Get("aa")
+	assert.Equal(t, ErrNotFound, err)
+
+	it := snap.NewIterator(IteratorOptions{})
+	var keys, values []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+		val, err := it.Value()
+		require.NoError(t, err)
+		values = append(values, string(val))
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+	assert.Equal(t, []string{"1", "2", "3"}, values)
+
+	// The live store moved on
+	assert.Equal(t, []string{"a", "aa", "c", "d"}, store.ListKeys())
+
+	snap.Release()
+	_, err = snap.Get("a")
+	assert.Equal(t, ErrSnapshotReleased, err)
+}
+
+func TestSnapshotPinsSegmentsAcrossCompaction(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer cleanupTestStore(t, store, dir)
+
+	require.NoError(t, store.Set("a", []byte("1")))
+	require.NoError(t, store.Set("b", []byte("2")))
+	oldID := store.activeSegmentID
+
+	snap := store.Snapshot()
+	require.NoError(t, store.Set("a", []byte("changed")))
+	require.NoError(t, store.Compact())
+
+	// The pre-compaction segment is still there for the snapshot
+	_, err := os.Stat(segmentPath(dir, oldID))
+	require.NoError(t, err)
+
+	// A second compaction moves b again; the snapshot must still find it
+	require.NoError(t, store.Delete("b"))
+	require.NoError(t, store.Compact())
+
+	val, err := snap.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), val)
+	val, err = snap.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), val)
+
+	snap.Release()
+	_, err = os.Stat(segmentPath(dir, oldID))
+	assert.True(t, os.IsNotExist(err))
+
+	val, err = store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("changed"), val)
+	_, err = store.Get("b")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestCloseRemovesSegmentsPinnedBySnapshots(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.Set("a", []byte("1")))
+	require.NoError(t, store.Set("b", []byte("2")))
+	oldID := store.activeSegmentID
+	_ = store.Snapshot()
+	require.NoError(t, store.Delete("b"))
+	require.NoError(t, store.Compact())
+
+	// Close releases leftover snapshots and deletes what they pinned
+	require.NoError(t, store.Close())
+	_, err := os.Stat(segmentPath(dir, oldID))
+	assert.True(t, os.IsNotExist(err))
+
+	store, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, store.ListKeys())
+}
+
+func TestSnapshotExpiry(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer cleanupTestStore(t, store, dir)
+
+	clock := &fakeClock{now: time.Now()}
+	store.now = clock.Now
+
+	require.NoError(t, store.SetWithTTL("session", []byte("x"), time.Second))
+	snap := store.Snapshot()
+	defer snap.Release()
+
+	// Keys expire as of the moment the snapshot was taken
+	clock.Advance(time.Minute)
+	require.NoError(t, store.Compact())
+	_, err := store.Get("session")
+	assert.Equal(t, ErrNotFound, err)
+
+	val, err := snap.Get("session")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("x"), val)
+}
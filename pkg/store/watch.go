@@ -0,0 +1,310 @@
+package store
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// watchBuffer is how many events a watcher may fall behind by before the
+// store gives up on it
+const watchBuffer = 1024
+
+// Event describes one change to a key
+type Event struct {
+	Op  byte   // OpSet or OpDelete
+	Key string // Key that changed
+	Seq uint64 // Sequence number of the write, which is the key's new version
+}
+
+// watcher receives the changes to keys under a prefix
+type watcher struct {
+	prefix string
+	events chan Event // Closed once the store stops delivering, guarded by mu
+	closed bool
+}
+
+// Watch returns a channel of the changes made from now on to keys starting
+// with prefix. See WatchFrom for when the channel is closed.
+func (s *KVStore) Watch(ctx context.Context, prefix string) <-chan Event {
+	// Nothing comes after the largest sequence, so there is no history to
+	// read and no error to report
+	events, _ := s.WatchFrom(ctx, prefix, math.MaxUint64)
+	return events
+}
+
+// WatchFrom returns a channel of the changes to keys starting with prefix
+// whose sequence number is greater than after, so a consumer can resume
+// from the last event it saw, even across restarts. Changes already in the
+// log come first, in sequence order, followed by changes as they are made.
+//
+// History only reaches back as far as compaction left it: a consumer
+// resuming from before a compaction sees the latest value of every key
+// changed since, but not the deletes compaction has folded away. Records
+// written before sequence numbers existed have none and never show up in
+// history.
+//
+// The channel is closed when ctx is done, when the store is closed, when
+// the consumer falls too far behind, or when the history cannot be read
+// to the end. In the last two cases, resume with WatchFrom from the last
+// sequence number received.
+func (s *KVStore) WatchFrom(ctx context.Context, prefix string, after uint64) (<-chan Event, error) {
+	s.mu.Lock()
+	w := &watcher{prefix: prefix, events: make(chan Event, watchBuffer)}
+	s.watchers[w] = struct{}{}
+
+	// Changes up to here come from the log; later ones reach the watcher.
+	// A snapshot keeps compaction from removing the segments until the
+	// history has been sent.
+	var h *history
+	var segments []uint64
+	if after < s.seq {
+		h = &history{
+			view:   s.newSnapshot(),
+			prefix: prefix,
+			after:  after,
+			upto:   s.seq,
+			active: s.activeSegmentID,
+			end:    s.activeOffset,
+		}
+		for segID := range s.segStats {
+			segments = append(segments, segID)
+		}
+	}
+	s.mu.Unlock()
+
+	if h != nil {
+		if err := s.findHistory(h, segments); err != nil {
+			h.view.Release()
+			s.mu.Lock()
+			s.closeWatcher(w)
+			s.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	out := make(chan Event)
+	go s.forward(ctx, w, h, out)
+	return out, nil
+}
+
+// forward delivers the history, if any, and then live events to out until
+// ctx is done or the store stops delivering to w
+func (s *KVStore) forward(ctx context.Context, w *watcher, h *history, out chan<- Event) {
+	defer close(out)
+	defer func() {
+		s.mu.Lock()
+		s.closeWatcher(w)
+		s.mu.Unlock()
+	}()
+
+	if h != nil && !s.sendHistory(ctx, h, out) {
+		return
+	}
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return
+			}
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// notify hands a change to every watcher of its key. Writers never wait
+// for a watcher: one whose buffer is full is dropped. Callers hold s.mu for
+// writing.
+func (s *KVStore) notify(op byte, key string, seq uint64) {
+	for w := range s.watchers {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- Event{Op: op, Key: key, Seq: seq}:
+		default:
+			s.logger.Warn("dropped watcher that fell behind", "prefix", w.prefix, "seq", seq)
+			s.closeWatcher(w)
+		}
+	}
+}
+
+// closeWatcher stops delivering to w; callers hold s.mu for writing
+func (s *KVStore) closeWatcher(w *watcher) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.events)
+	delete(s.watchers, w)
+}
+
+// history describes the changes a watcher catches up on from the log:
+// those under prefix with sequence numbers in (after, upto]. Only the first
+// end bytes of the active segment are read; the rest was written after
+// upto.
+type history struct {
+	view     *Snapshot
+	segments []historySegment // Segments holding changes, by first change
+	prefix   string
+	after    uint64
+	upto     uint64
+	active   uint64
+	end      uint64
+}
+
+// historySegment is a segment holding changes that belong to a history
+type historySegment struct {
+	id    uint64
+	first uint64 // Lowest sequence number among the changes
+}
+
+// findHistory fills in the segments holding changes for h, in the order
+// their changes start
+func (s *KVStore) findHistory(h *history, segments []uint64) error {
+	for _, segID := range segments {
+		first := uint64(math.MaxUint64)
+		if err := s.readHistory(h, segID, func(ev Event) {
+			first = min(first, ev.Seq)
+		}); err != nil {
+			return err
+		}
+		if first != math.MaxUint64 {
+			h.segments = append(h.segments, historySegment{id: segID, first: first})
+		}
+	}
+	sort.Slice(h.segments, func(i, j int) bool {
+		return h.segments[i].first < h.segments[j].first
+	})
+	return nil
+}
+
+// sendHistory delivers h to out in sequence order, holding no more of it in
+// memory than the segments whose changes overlap. It releases h's snapshot
+// when done and reports whether the whole history was sent.
+func (s *KVStore) sendHistory(ctx context.Context, h *history, out chan<- Event) bool {
+	defer h.view.Release()
+
+	var pending eventHeap
+	for i, seg := range h.segments {
+		if err := s.readHistory(h, seg.id, func(ev Event) {
+			heap.Push(&pending, ev)
+		}); err != nil {
+			s.logger.Warn("stopped watcher whose history could not be read", "prefix", h.prefix, "err", err)
+			return false
+		}
+
+		// Changes before the next segment's first one are complete. Compaction
+		// output sorts after segments holding newer writes, so segments can
+		// overlap, and a crash during compaction can leave the same write in
+		// two segments. The tombstone compaction writes for an expired value
+		// reuses the value's sequence number; it pops last and is the one
+		// kept.
+		next := uint64(math.MaxUint64)
+		if i+1 < len(h.segments) {
+			next = h.segments[i+1].first
+		}
+		for pending.Len() > 0 && pending[0].Seq < next {
+			ev := heap.Pop(&pending).(Event)
+			for pending.Len() > 0 && pending[0].Seq == ev.Seq {
+				ev = heap.Pop(&pending).(Event)
+			}
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// readHistory calls fn for each change in a segment that belongs to h
+func (s *KVStore) readHistory(h *history, segID uint64, fn func(ev Event)) error {
+	add := func(op byte, key string, seq uint64) {
+		if (op == OpSet || op == OpDelete) && seq > h.after && seq <= h.upto && strings.HasPrefix(key, h.prefix) {
+			fn(Event{Op: op, Key: key, Seq: seq})
+		}
+	}
+
+	// Sealed segments usually have hints, which spare reading values
+	hints, err := loadSegmentHints(s.baseDir, segID, s.keys)
+	if err == nil {
+		for _, hint := range hints {
+			add(hint.Op, hint.Key, hint.Seq)
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		s.logger.Warn("ignoring hint file", "segment", segID, "err", err)
+	}
+
+	if err := s.scanHistory(segID, segID == h.active, h.end, func(rec *Record) {
+		add(rec.Op, rec.Key, rec.Seq)
+	}); err != nil {
+		return fmt.Errorf("read history of segment %d: %w", segID, err)
+	}
+	return nil
+}
+
+// eventHeap orders events by sequence number, with a delete after a set
+// that shares its number
+type eventHeap []Event
+
+func (e eventHeap) Len() int { return len(e) }
+
+func (e eventHeap) Less(i, j int) bool {
+	if e[i].Seq != e[j].Seq {
+		return e[i].Seq < e[j].Seq
+	}
+	return e[i].Op != OpDelete && e[j].Op == OpDelete
+}
+
+func (e eventHeap) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+func (e *eventHeap) Push(x any) { *e = append(*e, x.(Event)) }
+
+func (e *eventHeap) Pop() any {
+	old := *e
+	ev := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return ev
+}
+
+// scanHistory calls fn for every committed record in a segment, reading no
+// further than end if limited
+func (s *KVStore) scanHistory(segID uint64, limited bool, end uint64, fn func(rec *Record)) error {
+	file, err := os.Open(segmentPath(s.baseDir, segID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	limit := int64(-1)
+	if limited {
+		limit = int64(end)
+	}
+	r, err := newSizedReader(file, limit)
+	if err != nil {
+		return err
+	}
+	_, _, err = scanCommitted(r, func(rec *Record, _ uint64) error {
+		if err := s.keys.openRecord(rec); err != nil {
+			return err
+		}
+		fn(rec)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receive reads n events from events, failing if they take too long
+func receive(t *testing.T, events <-chan Event, n int) []Event {
+	t.Helper()
+
+	var got []Event
+	for len(got) < n {
+		select {
+		case ev, ok := <-events:
+			require.True(t, ok, "channel closed after %d events", len(got))
+			got = append(got, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d events", len(got))
+		}
+	}
+	return got
+}
+
+// assertClosed checks that events is closed once drained
+func assertClosed(t *testing.T, events <-chan Event) {
+	t.Helper()
+
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("channel not closed")
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer cleanupTestStore(t, store, dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := store.Watch(ctx, "user:")
+
+	require.NoError(t, store.Set("user:1", []byte("alice")))
+	require.NoError(t, store.Set("order:1", []byte("ignored")))
+	require.NoError(t, store.Delete("user:1"))
+	b := NewBatch()
+	b.Set("user:2", []byte("bob"))
+	b.Set("order:2", []byte("ignored"))
+	require.NoError(t, store.Write(b))
+
+	assert.Equal(t, []Event{
+		{Op: OpSet, Key: "user:1", Seq: 1},
+		{Op: OpDelete, Key: "user:1", Seq: 3},
+		{Op: OpSet, Key: "user:2", Seq: 4},
+	}, receive(t, events, 3))
+
+	_, version, err := store.GetWithVersion("user:2")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), version)
+
+	cancel()
+	assertClosed(t, events)
+}
+
+func TestWatchFromResumesAfterRestart(t *testing.T) {
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	store, err := OpenWithOptions(dir, WithSegmentSize(128))
+	require.NoError(t, err)
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("k%02d", i), []byte("some value")))
+	}
+	require.NoError(t, store.Delete("k03"))
+	require.NoError(t, store.Close())
+
+	store, err = OpenWithOptions(dir, WithSegmentSize(128))
+	require.NoError(t, err)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	events, err := store.WatchFrom(context.Background(), "", 8)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("k11", []byte("live")))
+
+	assert.Equal(t, []Event{
+		{Op: OpSet, Key: "k09", Seq: 9},
+		{Op: OpSet, Key: "k10", Seq: 10},
+		{Op: OpDelete, Key: "k03", Seq: 11},
+		{Op: OpSet, Key: "k11", Seq: 12},
+	}, receive(t, events, 4))
+
+	// History survives compaction for keys that are still there
+	require.NoError(t, store.Compact())
+	events, err = store.WatchFrom(context.Background(), "k1", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []Event{
+		{Op: OpSet, Key: "k10", Seq: 10},
+		{Op: OpSet, Key: "k11", Seq: 12},
+	}, receive(t, events, 2))
+
+	require.NoError(t, store.Close())
+	assertClosed(t, events)
+}
+
+func TestWatchFromExpiredAcrossCompaction(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	clock := &fakeClock{now: time.Now()}
+	store.now = clock.Now
+
+	// An older segment outside the merge makes compaction keep a tombstone
+	// for the expired key, under the sequence number of its value
+	require.NoError(t, store.Set("old", []byte("v")))
+	require.NoError(t, store.rotateSegment())
+	olderID := store.activeSegmentID - 1
+	require.NoError(t, store.SetWithTTL("temp", []byte("x"), time.Second))
+	require.NoError(t, store.Set("keep", []byte("y")))
+	require.NoError(t, store.rotateSegment())
+	inputID := store.activeSegmentID - 1
+	input, err := os.ReadFile(segmentPath(dir, inputID))
+	require.NoError(t, err)
+
+	clock.Advance(time.Minute)
+	_, err = store.compact(func(st SegmentStats) bool { return st.ID != olderID })
+	require.NoError(t, err)
+
+	// Simulate a crash before the input was removed and the index saved,
+	// so replay finds both the value and its tombstone
+	require.NoError(t, store.Close())
+	require.NoError(t, os.WriteFile(segmentPath(dir, inputID), input, 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, snapshotFile)))
+	store, err = Open(dir)
+	require.NoError(t, err)
+	store.now = clock.Now
+
+	events, err := store.WatchFrom(context.Background(), "", 1)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("next", []byte("z")))
+	assert.Equal(t, []Event{
+		{Op: OpDelete, Key: "temp", Seq: 2},
+		{Op: OpSet, Key: "keep", Seq: 3},
+		{Op: OpSet, Key: "next", Seq: 4},
+	}, receive(t, events, 3))
+}
+
+func TestWatchFromMergesOverlappingSegments(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer func() { cleanupTestStore(t, store, dir) }()
+
+	require.NoError(t, store.Set("a", []byte("1")))
+	require.NoError(t, store.Set("b", []byte("2")))
+	require.NoError(t, store.rotateSegment())
+	middleID := store.activeSegmentID
+	require.NoError(t, store.Set("c", []byte("3")))
+	require.NoError(t, store.rotateSegment())
+	require.NoError(t, store.Set("a", []byte("4")))
+	require.NoError(t, store.Set("d", []byte("5")))
+	require.NoError(t, store.rotateSegment())
+
+	// The merged output holds changes from either side of the middle segment
+	_, err := store.compact(func(st SegmentStats) bool { return st.ID != middleID })
+	require.NoError(t, err)
+
+	events, err := store.WatchFrom(context.Background(), "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []Event{
+		{Op: OpSet, Key: "b", Seq: 2},
+		{Op: OpSet, Key: "c", Seq: 3},
+		{Op: OpSet, Key: "a", Seq: 4},
+		{Op: OpSet, Key: "d", Seq: 5},
+	}, receive(t, events, 4))
+
+	// The history no longer holds segments back
+	assert.Eventually(t, func() bool {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+		return len(store.snapshots) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWatchDropsSlowConsumer(t *testing.T) {
+	store, dir := setupTestStore(t)
+	defer cleanupTestStore(t, store, dir)
+
+	events := store.Watch(context.Background(), "")
+	total := watchBuffer + 100
+	for i := 0; i < total; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("v")))
+	}
+
+	// Everything up to the overflow arrives before the channel closes
+	var last uint64
+	for ev := range events {
+		assert.Equal(t, last+1, ev.Seq)
+		last = ev.Seq
+	}
+	require.Less(t, last, uint64(total))
+
+	resumed, err := store.WatchFrom(context.Background(), "", last)
+	require.NoError(t, err)
+	got := receive(t, resumed, total-int(last))
+	assert.Equal(t, last+1, got[0].Seq)
+	assert.Equal(t, uint64(total), got[len(got)-1].Seq)
+}
@@ -2,9 +2,12 @@ package volume
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,6 +20,7 @@ var startTime = time.Now()
 // AppState holds shared application state
 type AppState struct {
 	storage *BlobStorage
+	logger  *slog.Logger
 	mu      sync.RWMutex
 }
 
@@ -37,20 +41,39 @@ type HealthResponse struct {
 
 // MetricsResponse represents metrics response
 type MetricsResponse struct {
-	TotalKeys          int     `json:"total_keys"`
-	TotalSegments      int     `json:"total_segments"`
-	TotalBytes         uint64  `json:"total_bytes"`
-	TotalMB            float64 `json:"total_mb"`
-	ActiveSegmentID    int     `json:"active_segment_id"`
-	OldestSegmentID    int     `json:"oldest_segment_id"`
-	VolumeID           string  `json:"volume_id"`
-	UptimeSecs         int64   `json:"uptime_secs"`
-	AvgValueSizeBytes  float64 `json:"avg_value_size_bytes"`
+	TotalKeys         int              `json:"total_keys"`
+	TotalSegments     int              `json:"total_segments"`
+	TotalBytes        uint64           `json:"total_bytes"`
+	TotalMB           float64          `json:"total_mb"`
+	ActiveSegmentID   int              `json:"active_segment_id"`
+	OldestSegmentID   int              `json:"oldest_segment_id"`
+	VolumeID          string           `json:"volume_id"`
+	UptimeSecs        int64            `json:"uptime_secs"`
+	AvgValueSizeBytes float64          `json:"avg_value_size_bytes"`
+	CompressionRatio  float64          `json:"compression_ratio"`
+	Segments          []SegmentMetrics `json:"segments"`
 }
 
-// CreateRouter creates the HTTP router
-func CreateRouter(storage *BlobStorage) *mux.Router {
-	state := &AppState{storage: storage}
+// SegmentMetrics reports the live/dead breakdown of one segment
+type SegmentMetrics struct {
+	ID           uint64  `json:"id"`
+	LiveBytes    uint64  `json:"live_bytes"`
+	DeadBytes    uint64  `json:"dead_bytes"`
+	GarbageRatio float64 `json:"garbage_ratio"`
+}
+
+// WatchEvent is the data of a change event on the watch stream
+type WatchEvent struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	Seq uint64 `json:"seq"`
+}
+
+// CreateRouter creates the HTTP router. Failures to write responses are
+// logged to logger. The backup endpoint is only routed if adminBackup is
+// set, since it hands out the whole volume without authentication.
+func CreateRouter(storage *BlobStorage, logger *slog.Logger, adminBackup bool) *mux.Router {
+	state := &AppState{storage: storage, logger: logger}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", state.healthCheck).Methods("GET")
@@ -60,6 +83,10 @@ func CreateRouter(storage *BlobStorage) *mux.Router {
 	r.HandleFunc("/blobs/{key}", state.putBlob).Methods("POST")
 	r.HandleFunc("/blobs/{key}", state.getBlob).Methods("GET")
 	r.HandleFunc("/blobs/{key}", state.deleteBlob).Methods("DELETE")
+	r.HandleFunc("/watch", state.watch).Methods("GET")
+	if adminBackup {
+		r.HandleFunc("/admin/backup", state.backup).Methods("GET")
+	}
 
 	return r
 }
@@ -81,7 +108,7 @@ func (s *AppState) healthCheck(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding health check response: %v", err)
+		s.logger.Warn("failed to encode health check response", "err", err)
 	}
 }
 
@@ -96,6 +123,16 @@ func (s *AppState) metrics(w http.ResponseWriter, r *http.Request) {
 		avgValueSize = float64(stats.TotalBytes) / float64(stats.NumKeys)
 	}
 
+	segments := make([]SegmentMetrics, 0, len(stats.Segments))
+	for _, seg := range stats.Segments {
+		segments = append(segments, SegmentMetrics{
+			ID:           seg.ID,
+			LiveBytes:    seg.LiveBytes,
+			DeadBytes:    seg.DeadBytes,
+			GarbageRatio: seg.GarbageRatio(),
+		})
+	}
+
 	response := MetricsResponse{
 		TotalKeys:         stats.NumKeys,
 		TotalSegments:     stats.NumSegments,
@@ -106,37 +143,76 @@ func (s *AppState) metrics(w http.ResponseWriter, r *http.Request) {
 		VolumeID:          volumeID,
 		UptimeSecs:        int64(time.Since(startTime).Seconds()),
 		AvgValueSizeBytes: avgValueSize,
+		CompressionRatio:  stats.CompressionRatio(),
+		Segments:          segments,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding metrics response: %v", err)
+		s.logger.Warn("failed to encode metrics response", "err", err)
 	}
 }
 
+// uploadIdleTimeout is how long an upload may go without sending any of
+// its body before the server gives up on it
+const uploadIdleTimeout = 15 * time.Second
+
 func (s *AppState) putBlob(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	data, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeError(w, http.StatusBadRequest, "failed to read body: "+err.Error())
+	// An optional ?ttl=30s makes the blob expire
+	var ttl time.Duration
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 {
+			s.writeError(w, http.StatusBadRequest, "invalid ttl: "+raw)
+			return
+		}
+		ttl = parsed
+	}
+
+	// Uploads of large blobs take longer than the server's read timeout
+	// allows, so the deadline moves along with the upload instead
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(uploadIdleTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.logger.Warn("failed to set read deadline for upload", "err", err)
+	}
+
+	// The body streams straight into the store, which orders writes
+	// itself; holding s.mu for the whole upload would stall every other
+	// request. ContentLength is -1 when the client does not say.
+	body := &bodyReader{r: r.Body, rc: rc}
+	var meta *BlobMeta
+	var err error
+	if ttl > 0 {
+		meta, err = s.storage.PutReaderWithTTL(key, body, r.ContentLength, ttl)
+	} else {
+		meta, err = s.storage.PutReader(key, body, r.ContentLength)
+	}
+
+	if body.err != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		if body.err != nil {
+			err = body.err
+		}
+		s.writeError(w, http.StatusBadRequest, "failed to read body: "+err.Error())
 		return
 	}
 
-	s.mu.Lock()
-	meta, err := s.storage.Put(key, data)
-	s.mu.Unlock()
+	if errors.Is(err, store.ErrReadOnly) {
+		s.writeError(w, http.StatusForbidden, "Volume is read-only")
+		return
+	}
 
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(meta); err != nil {
-		log.Printf("Error encoding put blob response: %v", err)
+		s.logger.Warn("failed to encode put blob response", "err", err)
 	}
 }
 
@@ -145,24 +221,51 @@ func (s *AppState) getBlob(w http.ResponseWriter, r *http.Request) {
 	key := vars["key"]
 
 	s.mu.RLock()
-	data, err := s.storage.Get(key)
+	blob, err := s.storage.Open(key)
 	s.mu.RUnlock()
 
 	if err == store.ErrNotFound {
-		writeError(w, http.StatusNotFound, "Blob not found")
+		s.writeError(w, http.StatusNotFound, "Blob not found")
 		return
 	}
 
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer blob.Close()
+
+	// Large blobs take longer to send than the server's write timeout
+	// allows
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.logger.Warn("failed to clear write deadline for blob", "err", err)
+	}
 
+	// ServeContent streams the blob and answers range requests
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(data); err != nil {
-		log.Printf("Error writing blob data: %v", err)
+	http.ServeContent(w, r, "", time.Time{}, blob)
+}
+
+// bodyReader remembers the first error reading a request body, which is
+// the client's fault rather than the store's. Every read that gets data
+// pushes the read deadline uploadIdleTimeout further out, so an upload has
+// as long as it keeps moving but a stalled one is cut off.
+type bodyReader struct {
+	r   io.Reader
+	rc  *http.ResponseController
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n > 0 {
+		_ = b.rc.SetReadDeadline(time.Now().Add(uploadIdleTimeout))
+	}
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
 	}
+	return n, err
 }
 
 func (s *AppState) deleteBlob(w http.ResponseWriter, r *http.Request) {
@@ -173,8 +276,13 @@ func (s *AppState) deleteBlob(w http.ResponseWriter, r *http.Request) {
 	err := s.storage.Delete(key)
 	s.mu.Unlock()
 
+	if errors.Is(err, store.ErrReadOnly) {
+		s.writeError(w, http.StatusForbidden, "Volume is read-only")
+		return
+	}
+
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -188,14 +296,121 @@ func (s *AppState) listBlobs(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(keys); err != nil {
-		log.Printf("Error encoding list blobs response: %v", err)
+		s.logger.Warn("failed to encode list blobs response", "err", err)
+	}
+}
+
+// keepaliveInterval is how often an idle watch stream sends a comment, so
+// proxies keep it open and dead clients are noticed
+const keepaliveInterval = 15 * time.Second
+
+// watch streams changes to blobs as Server-Sent Events. ?prefix= limits
+// the keys watched. A client resumes from the last event it saw with
+// ?after=<seq> or the Last-Event-ID header; without either it only sees
+// changes made from now on.
+func (s *AppState) watch(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = r.URL.Query().Get("after")
+	}
+
+	var events <-chan store.Event
+	if after == "" {
+		events = s.storage.Watch(r.Context(), prefix)
+	} else {
+		seq, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "invalid sequence number: "+after)
+			return
+		}
+		if events, err = s.storage.WatchFrom(r.Context(), prefix, seq); err != nil {
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.logger.Warn("failed to clear write deadline for watch stream", "err", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		s.logger.Warn("failed to start watch stream", "err", err)
+		return
+	}
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		var err error
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				// Closed by the store; the client reconnects and resumes
+				return
+			}
+			err = writeEvent(w, ev)
+		case <-keepalive.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			s.logger.Debug("watch stream ended", "err", err)
+			return
+		}
+	}
+}
+
+// writeEvent writes a change as a Server-Sent Event whose ID is its
+// sequence number
+func writeEvent(w io.Writer, ev store.Event) error {
+	op := "set"
+	if ev.Op == store.OpDelete {
+		op = "delete"
+	}
+	data, err := json.Marshal(WatchEvent{Op: op, Key: ev.Key, Seq: ev.Seq})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, op, data)
+	return err
+}
+
+// backup streams a consistent tar archive of the volume, which
+// store.Restore unpacks into a new data directory
+func (s *AppState) backup(w http.ResponseWriter, r *http.Request) {
+	// Archives take longer to send than the server's write timeout allows
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.logger.Warn("failed to clear write deadline for backup", "err", err)
+	}
+
+	name := fmt.Sprintf("%s-%s.tar", s.storage.VolumeID(), time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	// Headers are gone by the time a failure shows up, so a truncated
+	// archive is all the client sees; Restore rejects it
+	start := time.Now()
+	if err := s.storage.Backup(w); err != nil {
+		s.logger.Error("backup failed", "err", err)
+		return
 	}
+	s.logger.Info("backup finished", "file", name, "duration", time.Since(start))
 }
 
-func writeError(w http.ResponseWriter, status int, message string) {
+func (s *AppState) writeError(w http.ResponseWriter, status int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(ErrorResponse{Error: message}); err != nil {
-		log.Printf("Error encoding error response: %v", err)
+		s.logger.Warn("failed to encode error response", "err", err)
 	}
 }
@@ -0,0 +1,170 @@
+package volume
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whispem/mini-kvstore-go/pkg/store"
+)
+
+// setupTestServer serves a fresh volume in testdata/<test name> over a
+// server with the given read timeout
+func setupTestServer(t *testing.T, readTimeout time.Duration, opts ...store.Option) (*httptest.Server, *BlobStorage, string) {
+	t.Helper()
+	dir := filepath.Join("testdata", t.Name())
+	require.NoError(t, os.RemoveAll(dir))
+
+	storage, err := NewBlobStorage(dir, "test-volume", opts...)
+	require.NoError(t, err)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := httptest.NewUnstartedServer(CreateRouter(storage, logger, false))
+	server.Config.ReadTimeout = readTimeout
+	server.Start()
+	return server, storage, dir
+}
+
+func cleanupTestServer(t *testing.T, server *httptest.Server, storage *BlobStorage, dir string) {
+	t.Helper()
+	server.Close()
+	if err := storage.Close(); err != nil {
+		t.Logf("warning: failed to close storage: %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Logf("warning: failed to remove test dir: %v", err)
+	}
+}
+
+// testBlob returns n bytes that differ from one offset to the next
+func testBlob(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	return data
+}
+
+func TestPutBlobStreams(t *testing.T) {
+	server, storage, dir := setupTestServer(t, 200*time.Millisecond, store.WithLargeValueThreshold(64*1024))
+	defer cleanupTestServer(t, server, storage, dir)
+
+	// A body of unknown length that takes several read timeouts to arrive
+	data := testBlob(1024 * 1024)
+	pr, pw := io.Pipe()
+	go func() {
+		for off := 0; off < len(data); off += 64 * 1024 {
+			if _, err := pw.Write(data[off : off+64*1024]); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		pw.Close()
+	}()
+
+	resp, err := http.Post(server.URL+"/blobs/big", "application/octet-stream", pr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var meta BlobMeta
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&meta))
+	assert.Equal(t, uint64(len(data)), meta.Size)
+	assert.Equal(t, fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)), meta.ETag)
+	assert.Nil(t, meta.ExpiresAt)
+
+	resp, err = http.Get(server.URL + "/blobs/big")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+}
+
+func TestGetBlobRange(t *testing.T) {
+	server, storage, dir := setupTestServer(t, 15*time.Second, store.WithLargeValueThreshold(64*1024))
+	defer cleanupTestServer(t, server, storage, dir)
+
+	small := testBlob(1000)
+	_, err := storage.Put("small", small)
+	require.NoError(t, err)
+	large := testBlob(300 * 1024)
+	_, err = storage.PutReader("large", bytes.NewReader(large), int64(len(large)))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		key        string
+		data       []byte
+		start, end int
+	}{
+		{"small", small, 100, 199},
+		{"large", large, 100 * 1024, 250*1024 - 1},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/blobs/"+tc.key, nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", tc.start, tc.end))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode, tc.key)
+		assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", tc.start, tc.end, len(tc.data)), resp.Header.Get("Content-Range"), tc.key)
+		assert.True(t, bytes.Equal(tc.data[tc.start:tc.end+1], got), tc.key)
+	}
+}
+
+func TestPutBlobTTL(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	server, storage, dir := setupTestServer(t, 15*time.Second, store.WithClock(clock))
+	defer cleanupTestServer(t, server, storage, dir)
+
+	for _, ttl := range []string{"soon", "0s", "-1m"} {
+		resp, err := http.Post(server.URL+"/blobs/session?ttl="+ttl, "text/plain", bytes.NewReader([]byte("token")))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, ttl)
+	}
+
+	resp, err := http.Post(server.URL+"/blobs/session?ttl=30m", "text/plain", bytes.NewReader([]byte("token")))
+	require.NoError(t, err)
+	var meta BlobMeta
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&meta))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NotNil(t, meta.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), *meta.ExpiresAt, time.Minute)
+
+	resp, err = http.Get(server.URL + "/blobs/session")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mu.Lock()
+	now = now.Add(time.Hour)
+	mu.Unlock()
+	resp, err = http.Get(server.URL + "/blobs/session")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -3,49 +3,71 @@ package volume
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/whispem/mini-kvstore-go/pkg/config"
+	"github.com/whispem/mini-kvstore-go/pkg/store"
 )
 
-// StartVolumeServer starts the HTTP server with graceful shutdown
-func StartVolumeServer(addr, volumeID, dataDir string, compactionThreshold, compactionIntervalSecs int) error {
+// StartVolumeServer starts the HTTP server described by cfg with graceful
+// shutdown. opts configure the underlying store; cfg.StoreOptions builds
+// them from the same configuration. The server and the store both log to
+// logger, tagged with the volume ID.
+func StartVolumeServer(cfg *config.Config, logger *slog.Logger, opts ...store.Option) error {
+	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
+	volumeID := cfg.VolumeID
+	compactionGarbageRatio := cfg.CompactionGarbageRatio
+	compactionIntervalSecs := cfg.CompactionIntervalSecs
+
+	logger = logger.With("volume", volumeID)
+	opts = append([]store.Option{store.WithLogger(logger)}, opts...)
+
 	// Create data directory
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return fmt.Errorf("failed to create data dir: %w", err)
+	if !cfg.ReadOnly {
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			return fmt.Errorf("failed to create data dir: %w", err)
+		}
 	}
 
 	// Initialize blob storage
-	storage, err := NewBlobStorage(dataDir, volumeID)
+	storage, err := NewBlobStorage(cfg.DataDir, volumeID, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create blob storage: %w", err)
 	}
 	defer func() {
 		if err := storage.Close(); err != nil {
-			log.Printf("Error closing storage: %v", err)
+			logger.Error("failed to close storage", "err", err)
 		}
 	}()
 
 	// Create HTTP router
-	router := CreateRouter(storage)
+	router := CreateRouter(storage, logger, cfg.AdminBackup)
 
-	// Create HTTP server
+	// Create HTTP server. Requests run under a context that shutdown
+	// cancels, which ends watch streams instead of waiting them out.
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 	server := &http.Server{
 		Addr:         addr,
 		Handler:      router,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return requestCtx },
 	}
+	server.RegisterOnShutdown(cancelRequests)
 
 	// Start compaction goroutine
 	stopCompaction := make(chan struct{})
 	compactionDone := make(chan struct{})
-	
-	if compactionIntervalSecs > 0 {
+
+	if compactionIntervalSecs > 0 && !cfg.ReadOnly {
 		go func() {
 			defer close(compactionDone)
 			ticker := time.NewTicker(time.Duration(compactionIntervalSecs) * time.Second)
@@ -54,14 +76,14 @@ func StartVolumeServer(addr, volumeID, dataDir string, compactionThreshold, comp
 			for {
 				select {
 				case <-ticker.C:
-					stats := storage.Stats()
-					if stats.NumSegments >= compactionThreshold {
-						log.Printf("[%s] Running compaction (segments=%d, threshold=%d)...", 
-							volumeID, stats.NumSegments, compactionThreshold)
-						if err := storage.Compact(); err != nil {
-							log.Printf("[%s] Compaction error: %v", volumeID, err)
-						} else {
-							log.Printf("[%s] Compaction completed", volumeID)
+					compacted, err := storage.CompactGarbage(compactionGarbageRatio)
+					if err != nil {
+						logger.Error("background compaction failed", "err", err)
+					} else if len(compacted) > 0 {
+						for _, seg := range compacted {
+							logger.Info("compacted segment",
+								"segment", seg.ID, "live_bytes", seg.LiveBytes, "dead_bytes", seg.DeadBytes,
+								"garbage_ratio", seg.GarbageRatio(), "threshold", compactionGarbageRatio)
 						}
 					}
 				case <-stopCompaction:
@@ -69,12 +91,14 @@ func StartVolumeServer(addr, volumeID, dataDir string, compactionThreshold, comp
 				}
 			}
 		}()
+	} else {
+		close(compactionDone)
 	}
 
 	// Setup graceful shutdown
 	serverErrors := make(chan error, 1)
 	go func() {
-		log.Printf("Server listening on %s (volume=%s)", addr, volumeID)
+		logger.Info("server listening", "addr", addr)
 		serverErrors <- server.ListenAndServe()
 	}()
 
@@ -88,16 +112,17 @@ func StartVolumeServer(addr, volumeID, dataDir string, compactionThreshold, comp
 			return fmt.Errorf("server error: %w", err)
 		}
 	case sig := <-shutdown:
-		log.Printf("Received signal %v, starting graceful shutdown...", sig)
+		logger.Info("starting graceful shutdown", "signal", sig.String())
 
 		// Stop compaction
 		close(stopCompaction)
 		<-compactionDone
 
 		// Save snapshot before shutdown
-		log.Printf("Saving snapshot...")
-		if err := storage.SaveSnapshot(); err != nil {
-			log.Printf("Warning: failed to save snapshot: %v", err)
+		if !cfg.ReadOnly {
+			if err := storage.SaveSnapshot(); err != nil {
+				logger.Warn("failed to save snapshot", "err", err)
+			}
 		}
 
 		// Shutdown HTTP server with timeout
@@ -108,7 +133,7 @@ func StartVolumeServer(addr, volumeID, dataDir string, compactionThreshold, comp
 			return fmt.Errorf("server shutdown error: %w", err)
 		}
 
-		log.Printf("Server stopped gracefully")
+		logger.Info("server stopped")
 	}
 
 	return nil
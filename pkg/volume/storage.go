@@ -1,18 +1,22 @@
 package volume
 
 import (
+	"context"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"time"
 
 	"github.com/whispem/mini-kvstore-go/pkg/store"
 )
 
 // BlobMeta contains metadata about a stored blob
 type BlobMeta struct {
-	Key      string `json:"key"`
-	ETag     string `json:"etag"`
-	Size     uint64 `json:"size"`
-	VolumeID string `json:"volume_id"`
+	Key       string     `json:"key"`
+	ETag      string     `json:"etag"`
+	Size      uint64     `json:"size"`
+	VolumeID  string     `json:"volume_id"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 // BlobStorage provides high-level blob operations
@@ -22,8 +26,8 @@ type BlobStorage struct {
 }
 
 // NewBlobStorage creates a new blob storage instance
-func NewBlobStorage(dataDir, volumeID string) (*BlobStorage, error) {
-	kvstore, err := store.Open(dataDir)
+func NewBlobStorage(dataDir, volumeID string, opts ...store.Option) (*BlobStorage, error) {
+	kvstore, err := store.OpenWithOptions(dataDir, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("open store: %w", err)
 	}
@@ -50,11 +54,88 @@ func (b *BlobStorage) Put(key string, data []byte) (*BlobMeta, error) {
 	}, nil
 }
 
+// PutWithTTL stores a blob that expires after ttl and returns metadata
+func (b *BlobStorage) PutWithTTL(key string, data []byte, ttl time.Duration) (*BlobMeta, error) {
+	etag := fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+
+	if err := b.store.SetWithTTL(key, data, ttl); err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	return &BlobMeta{
+		Key:       key,
+		ETag:      etag,
+		Size:      uint64(len(data)),
+		VolumeID:  b.volumeID,
+		ExpiresAt: &expiresAt,
+	}, nil
+}
+
+// PutReader stores a blob of size bytes read from r, or of unknown length
+// if size is -1, and returns metadata. Large blobs are streamed to disk
+// without being held in memory.
+func (b *BlobStorage) PutReader(key string, r io.Reader, size int64) (*BlobMeta, error) {
+	return b.putReader(key, r, size, 0)
+}
+
+// PutReaderWithTTL stores a blob read from r like PutReader that expires
+// after ttl and returns metadata
+func (b *BlobStorage) PutReaderWithTTL(key string, r io.Reader, size int64, ttl time.Duration) (*BlobMeta, error) {
+	return b.putReader(key, r, size, ttl)
+}
+
+func (b *BlobStorage) putReader(key string, r io.Reader, size int64, ttl time.Duration) (*BlobMeta, error) {
+	// The ETag and size are taken as the blob streams past
+	hash := crc32.NewIEEE()
+	counter := &countingReader{r: io.TeeReader(r, hash)}
+
+	var err error
+	if ttl > 0 {
+		err = b.store.PutReaderWithTTL(key, counter, size, ttl)
+	} else {
+		err = b.store.PutReader(key, counter, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &BlobMeta{
+		Key:      key,
+		ETag:     fmt.Sprintf("%08x", hash.Sum32()),
+		Size:     counter.n,
+		VolumeID: b.volumeID,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		meta.ExpiresAt = &expiresAt
+	}
+	return meta, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
 // Get retrieves a blob by key
 func (b *BlobStorage) Get(key string) ([]byte, error) {
 	return b.store.Get(key)
 }
 
+// Open returns a reader over a blob that loads large blobs from disk as it
+// goes. The caller must close it.
+func (b *BlobStorage) Open(key string) (io.ReadSeekCloser, error) {
+	return b.store.OpenValue(key)
+}
+
 // Delete removes a blob
 func (b *BlobStorage) Delete(key string) error {
 	return b.store.Delete(key)
@@ -65,6 +146,18 @@ func (b *BlobStorage) ListKeys() []string {
 	return b.store.ListKeys()
 }
 
+// Watch returns the changes made from now on to blobs whose key starts
+// with prefix
+func (b *BlobStorage) Watch(ctx context.Context, prefix string) <-chan store.Event {
+	return b.store.Watch(ctx, prefix)
+}
+
+// WatchFrom returns the changes to blobs whose key starts with prefix,
+// starting after sequence number after
+func (b *BlobStorage) WatchFrom(ctx context.Context, prefix string, after uint64) (<-chan store.Event, error) {
+	return b.store.WatchFrom(ctx, prefix, after)
+}
+
 // VolumeID returns the volume identifier
 func (b *BlobStorage) VolumeID() string {
 	return b.volumeID
@@ -80,11 +173,21 @@ func (b *BlobStorage) Compact() error {
 	return b.store.Compact()
 }
 
+// CompactGarbage compacts the segments whose garbage ratio reaches minRatio
+func (b *BlobStorage) CompactGarbage(minRatio float64) ([]store.SegmentStats, error) {
+	return b.store.CompactGarbage(minRatio)
+}
+
 // SaveSnapshot saves index snapshot
 func (b *BlobStorage) SaveSnapshot() error {
 	return b.store.SaveSnapshot()
 }
 
+// Backup writes a point-in-time tar archive of the volume to w
+func (b *BlobStorage) Backup(w io.Writer) error {
+	return b.store.Backup(w)
+}
+
 // Close closes the storage
 func (b *BlobStorage) Close() error {
 	return b.store.Close()